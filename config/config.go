@@ -1,15 +1,9 @@
 package config
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/eclipse-aerios/federator/models"
-	"github.com/joho/godotenv"
 )
 
 const (
@@ -25,127 +19,239 @@ const (
 	REGISTRATIONS_PREFIX     string = "urn:aerios:federation"
 )
 
+// Context brokers supported as the broker of the domain
+const (
+	ORIONLD_CB_TYPE string = "orionld"
+	SCORPIO_CB_TYPE string = "scorpio"
+	STELLIO_CB_TYPE string = "stellio"
+)
+
+var CB_TYPES []string = []string{ORIONLD_CB_TYPE, SCORPIO_CB_TYPE, STELLIO_CB_TYPE}
+
+// Modes of the NGSI-LD context source registrations. The exclusive registrations must be limited to some
+// attributes of the entity types.
+var CSR_MODES []string = []string{"inclusive", "exclusive", "redirect", "auxiliary"}
+
 var REGISTRATIONS_TYPES []string = []string{
 	"organizations",
 	"infrastructure",
 	"services",
 }
 
-var APP_ENV string
-var APP_PORT string
-var IS_ENTRYPOINT bool
-var DOMAIN_NAME string
-var DOMAIN_DESCRIPTION string
-var DOMAIN_PUBLIC_URL string
-var DOMAIN_OWNER string
-var DOMAIN_CB_URL string
-var DOMAIN_CB_HEALTH_URL string
-var PEER_FEDERATOR_URL string
-var BROKER_ID string
-var LOCAL_DOMAIN *models.NewDomain
-var CB_HEALTH_CHECK_MODE string
-var CB_TOKEN_MODE string
-var TLS_CERTIFICATE_VALIDATION bool
-var AERIOS_SHIM_URL string
-var CB_OAUTH_CLIENT_ID string
-var CB_OAUTH_CLIENT_SECRET string
-var KEYCLOAK_URL string
-var KEYCLOAK_REALM string
-var DOMAIN_FEDERATOR_URL string
-var Status string = HEALTHY_STATUS
-var OrionToken *models.KeycloakAccessToken
-var PeerFederatorDomain string
-
-// TODO replace by an init function?
-func LoadEnvVars() {
-	var err error
-	var isAppEnvPresent bool
-	var isAppPortPresent bool
-
-	APP_ENV, isAppEnvPresent = os.LookupEnv("APP_ENV")
-	if !isAppEnvPresent || APP_ENV == "" {
-		APP_ENV = "development"
-	}
-	log.Println("Federator environment mode: " + APP_ENV)
-	// DEV Load environment variables from .env file -> change the "env" variable to use a specific file -> Uncomment
-	if APP_ENV != "production" {
-		const envsFolder = "test/"
-		const envFile = ""
-		log.Println("Not in production mode, so loading env vars from the local file " + envsFolder + envFile + ".env")
-		if err := godotenv.Load(envsFolder + envFile + ".env"); err != nil {
-			log.Fatalf("Error loading .env file: %v", err)
-		}
-	}
+// Configuration of the Federator. Each field can be set in the YAML config file (yaml tag), overridden by
+// an env var (env tag) and then by a CLI flag, whose name is the env var in kebab case (e.g. --domain-cb-url).
+// The fields with a reload tag cannot be changed by a hot reload: "identity" ones are part of the identity of
+// the domain in the continuum and "startup" ones are only applied when the Federator starts.
+type Config struct {
+	AppEnv                   string               `yaml:"appEnv" env:"APP_ENV" reload:"startup"`
+	AppPort                  string               `yaml:"appPort" env:"APP_PORT" reload:"startup"`
+	AdminToken               string               `yaml:"adminToken" env:"ADMIN_TOKEN"`
+	IsEntrypoint             bool                 `yaml:"isEntrypoint" env:"IS_ENTRYPOINT" reload:"identity"`
+	EphemeralDomain          bool                 `yaml:"ephemeralDomain" env:"EPHEMERAL_DOMAIN"`
+	Domain                   DomainConfig         `yaml:"domain"`
+	PeerFederatorUrl         string               `yaml:"peerFederatorUrl" env:"PEER_FEDERATOR_URL"`
+	CbType                   string               `yaml:"cbType" env:"CB_TYPE" reload:"startup"`
+	CbHealthCheckMode        string               `yaml:"cbHealthCheckMode" env:"CB_HEALTH_CHECK_MODE"`
+	AeriosContextUrl         string               `yaml:"aeriosContextUrl" env:"AERIOS_CONTEXT_URL" reload:"startup"`
+	TlsCertificateValidation bool                 `yaml:"tlsCertificateValidation" env:"TLS_CERTIFICATE_VALIDATION" reload:"startup"`
+	Tls                      TlsConfig            `yaml:"tls"`
+	CbToken                  CbTokenConfig        `yaml:"cbToken"`
+	AuthProfiles             []AuthProfileConfig  `yaml:"authProfiles" env:"AUTH_PROFILES"`
+	CsrTemplates             []models.CSRTemplate `yaml:"csrTemplates" env:"CSR_TEMPLATES"`
+	CsrTemplatesFile         string               `yaml:"csrTemplatesFile" env:"CSR_TEMPLATES_FILE"`
+	SharingPolicy            models.SharingPolicy `yaml:"sharingPolicy" env:"SHARING_POLICY"`
+	SharingPolicyFile        string               `yaml:"sharingPolicyFile" env:"SHARING_POLICY_FILE"`
+	SharingReconcileInterval time.Duration        `yaml:"sharingReconcileInterval" env:"SHARING_RECONCILE_INTERVAL"`
+	Lease                    LeaseConfig          `yaml:"lease"`
+	CsrLease                 CsrLeaseConfig       `yaml:"csrLease"`
+	HealthMonitor            HealthMonitorConfig  `yaml:"healthMonitor"`
+	ShadowJoin               ShadowJoinConfig     `yaml:"shadowJoin"`
+	CircuitBreaker           CircuitBreakerConfig `yaml:"circuitBreaker"`
+	Outbox                   OutboxConfig         `yaml:"outbox"`
+	Initialization           InitializationConfig `yaml:"initialization"`
+	ReadinessCheckInterval   time.Duration        `yaml:"readinessCheckInterval" env:"READINESS_CHECK_INTERVAL"`
+	ShutdownTimeout          time.Duration        `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+	KnownDomainsFile         string               `yaml:"knownDomainsFile" env:"KNOWN_DOMAINS_FILE" reload:"startup"`
+	ConfigWatchInterval      time.Duration        `yaml:"configWatchInterval" env:"CONFIG_WATCH_INTERVAL"`
+	file                     string
+}
 
-	APP_PORT, isAppPortPresent = os.LookupEnv("APP_PORT")
-	if !isAppPortPresent || APP_PORT == "" {
-		APP_PORT = "8050"
-	}
-	_, isEntrypointPresent := os.LookupEnv("IS_ENTRYPOINT")
-	if !isEntrypointPresent {
-		log.Println("IS_ENTRYPOINT env var not present, setting to false")
-		IS_ENTRYPOINT = false
-	} else {
-		IS_ENTRYPOINT, err = strconv.ParseBool(os.Getenv("IS_ENTRYPOINT"))
-		if err != nil {
-			log.Panicln("Error loading the IS_ENTRYPOINT environment variable")
-		}
-	}
-	if IS_ENTRYPOINT {
-		log.Println("ENTRYPOINT MODE")
+// Identity of the domain in which the Federator is deployed
+type DomainConfig struct {
+	Name              string                    `yaml:"name" env:"DOMAIN_NAME" reload:"identity"`
+	Description       string                    `yaml:"description" env:"DOMAIN_DESCRIPTION" reload:"identity"`
+	PublicUrl         string                    `yaml:"publicUrl" env:"DOMAIN_PUBLIC_URL" reload:"identity"`
+	Owner             string                    `yaml:"owner" env:"DOMAIN_OWNER" reload:"identity"`
+	CbUrl             string                    `yaml:"cbUrl" env:"DOMAIN_CB_URL" reload:"identity"`
+	CbTenant          string                    `yaml:"cbTenant" env:"DOMAIN_CB_TENANT" reload:"identity"`
+	CbHealthUrl       string                    `yaml:"cbHealthUrl" env:"DOMAIN_CB_HEALTH_URL"`
+	FederatorUrl      string                    `yaml:"federatorUrl" env:"DOMAIN_FEDERATOR_URL" reload:"identity"`
+	BrokerUrl         string                    `yaml:"brokerUrl" env:"DOMAIN_BROKER_URL" reload:"identity"`
+	SharedEntityTypes []models.SharedEntityType `yaml:"sharedEntityTypes" env:"DOMAIN_SHARED_ENTITY_TYPES" reload:"identity"`
+	Labels            []string                  `yaml:"labels" env:"DOMAIN_LABELS" reload:"identity"`
+	Location          *models.Geometry          `yaml:"location" env:"DOMAIN_LOCATION" reload:"identity"`
+}
+
+// Retrieval of the authorization token attached to the calls to the brokers and the other Federators
+type CbTokenConfig struct {
+	Mode                  string        `yaml:"mode" env:"CB_TOKEN_MODE"`
+	AeriosShimUrl         string        `yaml:"aeriosShimUrl" env:"AERIOS_SHIM_URL"`
+	StaticToken           string        `yaml:"staticToken" env:"CB_STATIC_TOKEN"`
+	TokenFile             string        `yaml:"tokenFile" env:"CB_TOKEN_FILE"`
+	OAuthClientId         string        `yaml:"oauthClientId" env:"CB_OAUTH_CLIENT_ID"`
+	OAuthClientAuthMethod string        `yaml:"oauthClientAuthMethod" env:"CB_OAUTH_CLIENT_AUTH_METHOD"`
+	OAuthClientSecret     string        `yaml:"oauthClientSecret" env:"CB_OAUTH_CLIENT_SECRET"`
+	OAuthPrivateKeyFile   string        `yaml:"oauthPrivateKeyFile" env:"CB_OAUTH_PRIVATE_KEY_FILE"`
+	OAuthKeyId            string        `yaml:"oauthKeyId" env:"CB_OAUTH_KEY_ID"`
+	KeycloakUrl           string        `yaml:"keycloakUrl" env:"KEYCLOAK_URL"`
+	KeycloakRealm         string        `yaml:"keycloakRealm" env:"KEYCLOAK_REALM"`
+	RefreshMargin         time.Duration `yaml:"refreshMargin" env:"CB_TOKEN_REFRESH_MARGIN"`
+}
+
+// Trust and client authentication of the outbound TLS connections (brokers, Federators, Keycloak and shim).
+// The CA bundle is trusted in addition to the system CAs.
+type TlsConfig struct {
+	CaFile         string              `yaml:"caFile" env:"TLS_CA_FILE" reload:"startup"`
+	ClientCertFile string              `yaml:"clientCertFile" env:"TLS_CLIENT_CERT_FILE" reload:"startup"`
+	ClientKeyFile  string              `yaml:"clientKeyFile" env:"TLS_CLIENT_KEY_FILE" reload:"startup"`
+	Overrides      []TlsOverrideConfig `yaml:"overrides" env:"TLS_OVERRIDES" reload:"startup"`
+}
+
+// TLS settings of the destinations matching any of its domains or URL patterns (same matching as the auth
+// profiles). Unset fields keep the global values.
+type TlsOverrideConfig struct {
+	Name                  string   `yaml:"name"`
+	Domains               []string `yaml:"domains"`
+	UrlPatterns           []string `yaml:"urlPatterns"`
+	CertificateValidation *bool    `yaml:"certificateValidation"`
+	CaFile                string   `yaml:"caFile"`
+}
+
+// Credentials presented to the destinations matching any of its domains or URL patterns, instead of the
+// default ones (cbToken). URL patterns are URL prefixes in which * matches any characters except /.
+type AuthProfileConfig struct {
+	Name        string        `yaml:"name"`
+	Domains     []string      `yaml:"domains"`
+	UrlPatterns []string      `yaml:"urlPatterns"`
+	Token       CbTokenConfig `yaml:"token"`
+}
+
+type LeaseConfig struct {
+	RenewalInterval time.Duration `yaml:"renewalInterval" env:"DOMAIN_LEASE_RENEWAL_INTERVAL"`
+	Duration        time.Duration `yaml:"duration" env:"DOMAIN_LEASE_DURATION"`
+	ExpiryCheck     string        `yaml:"expiryCheck" env:"DOMAIN_LEASE_EXPIRY_CHECK" reload:"startup"`
+}
+
+// Expiry (expiresAt) of the CSRs pointing to the other domains, renewed while the domains are healthy, so the
+// CSRs of dead domains lapse even if their deletion is never notified
+type CsrLeaseConfig struct {
+	Enabled         bool          `yaml:"enabled" env:"CSR_LEASE_ENABLED" reload:"startup"`
+	RenewalInterval time.Duration `yaml:"renewalInterval" env:"CSR_LEASE_RENEWAL_INTERVAL"`
+	Duration        time.Duration `yaml:"duration" env:"CSR_LEASE_DURATION"`
+}
+
+type HealthMonitorConfig struct {
+	Interval         time.Duration `yaml:"interval" env:"HEALTH_MONITOR_INTERVAL"`
+	FailureThreshold int           `yaml:"failureThreshold" env:"HEALTH_MONITOR_FAILURE_THRESHOLD"`
+	AutoStatus       bool          `yaml:"autoStatus" env:"HEALTH_MONITOR_AUTO_STATUS"`
+}
+
+// Shadow (canary) join mode of the domains that join the continuum through this Federator or are notified to it
+type ShadowJoinConfig struct {
+	Enabled         bool `yaml:"enabled" env:"SHADOW_JOIN_ENABLED"`
+	AutoPromote     bool `yaml:"autoPromote" env:"SHADOW_JOIN_AUTO_PROMOTE"`
+	PromotionChecks int  `yaml:"promotionChecks" env:"SHADOW_JOIN_PROMOTION_CHECKS"`
+}
+
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failureThreshold" env:"CIRCUIT_BREAKER_FAILURE_THRESHOLD"`
+	Cooldown         time.Duration `yaml:"cooldown" env:"CIRCUIT_BREAKER_COOLDOWN"`
+}
+
+type OutboxConfig struct {
+	RetryInterval time.Duration `yaml:"retryInterval" env:"OUTBOX_RETRY_INTERVAL"`
+	MaxAttempts   int           `yaml:"maxAttempts" env:"OUTBOX_MAX_ATTEMPTS"`
+}
+
+type InitializationConfig struct {
+	RetryInitialBackoff time.Duration `yaml:"retryInitialBackoff" env:"INIT_RETRY_INITIAL_BACKOFF"`
+	RetryMaxBackoff     time.Duration `yaml:"retryMaxBackoff" env:"INIT_RETRY_MAX_BACKOFF"`
+}
+
+// Returns the configuration with the default values, which are overridden by the config file, env vars and flags
+func Default() *Config {
+	return &Config{
+		AppEnv:                   "development",
+		AppPort:                  "8050",
+		CbType:                   ORIONLD_CB_TYPE,
+		CbHealthCheckMode:        "socket",
+		TlsCertificateValidation: false,
+		CbToken: CbTokenConfig{
+			Mode:                  "shim",
+			OAuthClientAuthMethod: "client_secret",
+			RefreshMargin:         30 * time.Second,
+		},
+		CsrTemplates:             models.DefaultCSRTemplates(),
+		SharingReconcileInterval: 5 * time.Minute,
+		Lease: LeaseConfig{
+			RenewalInterval: 30 * time.Second,
+			Duration:        90 * time.Second,
+			ExpiryCheck:     "all",
+		},
+		CsrLease: CsrLeaseConfig{
+			RenewalInterval: 2 * time.Minute,
+			Duration:        10 * time.Minute,
+		},
+		HealthMonitor: HealthMonitorConfig{
+			Interval:         60 * time.Second,
+			FailureThreshold: 3,
+		},
+		ShadowJoin: ShadowJoinConfig{
+			AutoPromote:     true,
+			PromotionChecks: 3,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 5,
+			Cooldown:         30 * time.Second,
+		},
+		Outbox: OutboxConfig{
+			RetryInterval: 30 * time.Second,
+			MaxAttempts:   10,
+		},
+		Initialization: InitializationConfig{
+			RetryInitialBackoff: 2 * time.Second,
+			RetryMaxBackoff:     60 * time.Second,
+		},
+		ReadinessCheckInterval: 10 * time.Second,
+		ShutdownTimeout:        30 * time.Second,
+		ConfigWatchInterval:    10 * time.Second,
 	}
+}
 
-	DOMAIN_NAME = strings.ReplaceAll(os.Getenv("DOMAIN_NAME"), " ", "")
-	DOMAIN_DESCRIPTION = os.Getenv("DOMAIN_DESCRIPTION")
-	DOMAIN_PUBLIC_URL = os.Getenv("DOMAIN_PUBLIC_URL")
-	DOMAIN_OWNER = os.Getenv("DOMAIN_OWNER")
-	DOMAIN_CB_URL = os.Getenv("DOMAIN_CB_URL")
-	DOMAIN_CB_HEALTH_URL = os.Getenv("DOMAIN_CB_HEALTH_URL")
-	DOMAIN_FEDERATOR_URL = os.Getenv("DOMAIN_FEDERATOR_URL")
-	PEER_FEDERATOR_URL = os.Getenv("PEER_FEDERATOR_URL")
-	CB_HEALTH_CHECK_MODE = os.Getenv("CB_HEALTH_CHECK_MODE")
-
-	_, isCBTokenModePresent := os.LookupEnv("CB_TOKEN_MODE")
-	if !isCBTokenModePresent {
-		log.Println("CB_TOKEN_MODE env var not present, setting to shim")
-		CB_TOKEN_MODE = "shim"
-	} else {
-		CB_TOKEN_MODE = os.Getenv("CB_TOKEN_MODE")
-		if CB_TOKEN_MODE != "shim" && CB_TOKEN_MODE != "keycloak" {
-			log.Println("CB_TOKEN_MODE has no valid value: " + CB_TOKEN_MODE + ", so setting to shim")
-			CB_TOKEN_MODE = "shim"
-		}
+// Returns the token settings of an auth profile, or the default ones if the profile name is empty
+func (c *Config) TokenSettings(profile string) (CbTokenConfig, bool) {
+	if profile == "" {
+		return c.CbToken, true
 	}
-	log.Println("Context Broker Authorization token mode: " + CB_TOKEN_MODE)
-
-	AERIOS_SHIM_URL = os.Getenv("AERIOS_SHIM_URL")
-	CB_OAUTH_CLIENT_ID = os.Getenv("CB_OAUTH_CLIENT_ID")
-	CB_OAUTH_CLIENT_SECRET = os.Getenv("CB_OAUTH_CLIENT_SECRET")
-	KEYCLOAK_URL = os.Getenv("KEYCLOAK_URL")
-	KEYCLOAK_REALM = os.Getenv("KEYCLOAK_REALM")
-
-	_, isTlsValPresent := os.LookupEnv("TLS_CERTIFICATE_VALIDATION")
-	if !isTlsValPresent {
-		log.Println("TLS_CERTIFICATE_VALIDATION env var not present, setting to false")
-		TLS_CERTIFICATE_VALIDATION = false
-	} else {
-		TLS_CERTIFICATE_VALIDATION, err = strconv.ParseBool(os.Getenv("TLS_CERTIFICATE_VALIDATION"))
-		if err != nil {
-			log.Panicln("Error loading the TLS_CERTIFICATE_VALIDATION environment variable")
+	for _, authProfile := range c.AuthProfiles {
+		if authProfile.Name == profile {
+			return authProfile.Token, true
 		}
 	}
+	return CbTokenConfig{}, false
+}
 
-	OrionToken = &models.KeycloakAccessToken{
-		AccessToken: "",
-		ExpiresAt:   time.Now().Add(-1 * time.Minute), // Token is expired
-	}
-
-	fmt.Println("")
+// Returns the path of the config file the configuration was loaded from, if any
+func (c *Config) File() string {
+	return c.file
+}
 
-	// create here the localDomain variable as a constant
-	LOCAL_DOMAIN = &models.NewDomain{
-		Name:         DOMAIN_NAME,
-		PublicUrl:    DOMAIN_PUBLIC_URL,
-		IsEntrypoint: IS_ENTRYPOINT,
+// Returns the files whose changes trigger a hot reload
+func (c *Config) WatchedFiles() (files []string) {
+	for _, file := range []string{c.file, c.CsrTemplatesFile, c.SharingPolicyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
 	}
+	return
 }
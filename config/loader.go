@@ -0,0 +1,280 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const CONFIG_FILE_ENV_VAR = "FEDERATOR_CONFIG_FILE"
+const ENV_FILE_ENV_VAR = "ENV_FILE"
+const DEVELOPMENT_ENV_FILE = "test/.env"
+
+// Leaf field of the Config struct that can be set through an env var and a CLI flag
+type configField struct {
+	env    string
+	flag   string
+	reload string
+	value  reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Loads the configuration from the YAML config file, the env vars and the CLI flags, in that order of
+// precedence, and validates it. All the invalid fields are reported at once in the returned error.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	fields := configFields(reflect.ValueOf(cfg).Elem())
+
+	flagSet := flag.NewFlagSet("federator", flag.ContinueOnError)
+	configFile := flagSet.String("config", "", "path of the YAML config file (or "+CONFIG_FILE_ENV_VAR+" env var)")
+	envFile := flagSet.String("env-file", "", "path of a .env file with env vars to load (or "+ENV_FILE_ENV_VAR+" env var)")
+	fieldsByFlag := make(map[string]configField, len(fields))
+	for _, field := range fields {
+		flagSet.String(field.flag, "", "overrides the "+field.env+" env var")
+		fieldsByFlag[field.flag] = field
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// An explicit env file is read first, so it can also set the config file. The env files are resolved
+	// into the config on each load, so the process environment is not changed.
+	env := environment{}
+	if *envFile == "" {
+		*envFile = os.Getenv(ENV_FILE_ENV_VAR)
+	}
+	if *envFile != "" {
+		vars, err := readEnvFile(*envFile)
+		if err != nil {
+			return nil, err
+		}
+		env = vars
+	}
+
+	if *configFile == "" {
+		*configFile = env.get(CONFIG_FILE_ENV_VAR)
+	}
+	if *configFile != "" {
+		log.Println("Loading the configuration file " + *configFile)
+		if err := loadConfigFile(*configFile, cfg); err != nil {
+			return nil, err
+		}
+		cfg.file = *configFile
+	}
+
+	// The development env file is only loaded once the environment mode is known, since it can be set by
+	// the config file, the env var or the flag
+	if *envFile == "" && appEnvOf(cfg, env, flagSet) != "production" {
+		if _, err := os.Stat(DEVELOPMENT_ENV_FILE); err == nil {
+			vars, err := readEnvFile(DEVELOPMENT_ENV_FILE)
+			if err != nil {
+				return nil, err
+			}
+			env = vars
+		}
+	}
+
+	var errs []error
+	for _, field := range fields {
+		if value := env.get(field.env); value != "" {
+			errs = append(errs, setField(field, value, field.env))
+		}
+	}
+	flagSet.Visit(func(f *flag.Flag) {
+		if field, isField := fieldsByFlag[f.Name]; isField {
+			errs = append(errs, setField(field, f.Value.String(), "--"+f.Name))
+		}
+	})
+
+	cfg.Domain.Name = strings.ReplaceAll(cfg.Domain.Name, " ", "")
+	if cfg.CsrTemplatesFile != "" {
+		errs = append(errs, loadCsrTemplatesFile(cfg))
+	}
+	if cfg.SharingPolicyFile != "" {
+		errs = append(errs, loadSharingPolicyFile(cfg))
+	}
+	for i := range cfg.AuthProfiles {
+		token := &cfg.AuthProfiles[i].Token
+		if token.OAuthClientAuthMethod == "" {
+			token.OAuthClientAuthMethod = cfg.CbToken.OAuthClientAuthMethod
+		}
+		if token.RefreshMargin == 0 {
+			token.RefreshMargin = cfg.CbToken.RefreshMargin
+		}
+	}
+
+	errs = append(errs, cfg.Validate())
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	cfg.logSummary()
+	return cfg, nil
+}
+
+// Env vars read from an env file, which don't override the ones of the process
+type environment map[string]string
+
+func (e environment) get(name string) string {
+	if value, isPresent := os.LookupEnv(name); isPresent {
+		return value
+	}
+	return e[name]
+}
+
+// Returns the environment mode of the config file, overridden by the env var and then by the flag
+func appEnvOf(cfg *Config, env environment, flagSet *flag.FlagSet) string {
+	appEnv := cfg.AppEnv
+	if value := env.get("APP_ENV"); value != "" {
+		appEnv = value
+	}
+	flagSet.Visit(func(f *flag.Flag) {
+		if f.Name == "app-env" && f.Value.String() != "" {
+			appEnv = f.Value.String()
+		}
+	})
+	return appEnv
+}
+
+// Reads the env vars of a .env file
+func readEnvFile(envFile string) (environment, error) {
+	log.Println("Loading env vars from the file " + envFile)
+	vars, err := godotenv.Read(envFile)
+	if err != nil {
+		return nil, errors.New("error loading the env file " + envFile + ": " + err.Error())
+	}
+	return vars, nil
+}
+
+// Decodes the YAML config file over the default values, rejecting unknown fields (e.g. typos)
+func loadConfigFile(configFile string, cfg *Config) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return errors.New("error reading the config file: " + err.Error())
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return errors.New("error decoding the config file " + configFile + ": " + err.Error())
+	}
+	return nil
+}
+
+// Loads the CSR templates from their own YAML file (a list of templates), replacing the ones of the config file
+func loadCsrTemplatesFile(cfg *Config) error {
+	data, err := os.ReadFile(cfg.CsrTemplatesFile)
+	if err != nil {
+		return errors.New("CSR_TEMPLATES_FILE: error reading the CSR templates file: " + err.Error())
+	}
+	var templates []models.CSRTemplate
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&templates); err != nil && !errors.Is(err, io.EOF) {
+		return errors.New("CSR_TEMPLATES_FILE: error decoding the CSR templates file " + cfg.CsrTemplatesFile + ": " + err.Error())
+	}
+	cfg.CsrTemplates = templates
+	return nil
+}
+
+// Loads the sharing policy from its own YAML file, replacing the one of the config file
+func loadSharingPolicyFile(cfg *Config) error {
+	data, err := os.ReadFile(cfg.SharingPolicyFile)
+	if err != nil {
+		return errors.New("SHARING_POLICY_FILE: error reading the sharing policy file: " + err.Error())
+	}
+	var policy models.SharingPolicy
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		return errors.New("SHARING_POLICY_FILE: error decoding the sharing policy file " + cfg.SharingPolicyFile + ": " + err.Error())
+	}
+	cfg.SharingPolicy = policy
+	return nil
+}
+
+// Returns the leaf fields of the struct that have an env tag, including the ones of nested structs
+func configFields(v reflect.Value) (fields []configField) {
+	for i := 0; i < v.NumField(); i++ {
+		structField := v.Type().Field(i)
+		if env := structField.Tag.Get("env"); env != "" {
+			fields = append(fields, configField{
+				env:    env,
+				flag:   strings.ToLower(strings.ReplaceAll(env, "_", "-")),
+				reload: structField.Tag.Get("reload"),
+				value:  v.Field(i),
+			})
+		} else if structField.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i))...)
+		}
+	}
+	return
+}
+
+// Sets the value of a field from its string representation (env var or flag value)
+func setField(field configField, value string, source string) error {
+	switch {
+	case field.value.Type() == durationType:
+		duration, err := parseDuration(value)
+		if err != nil {
+			return errors.New(source + ": invalid duration " + strconv.Quote(value) + " (use seconds or a duration such as 30s)")
+		}
+		field.value.SetInt(int64(duration))
+	case field.value.Kind() == reflect.Bool:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New(source + ": invalid boolean " + strconv.Quote(value))
+		}
+		field.value.SetBool(boolean)
+	case field.value.Kind() == reflect.Slice || field.value.Kind() == reflect.Struct || field.value.Kind() == reflect.Pointer:
+		// Lists and objects are set as YAML or JSON (e.g. AUTH_PROFILES='[{"name": "other-idp", ...}]')
+		parsed := reflect.New(field.value.Type())
+		if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+			return errors.New(source + ": invalid value: " + err.Error())
+		}
+		field.value.Set(parsed.Elem())
+	case field.value.Kind() == reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New(source + ": invalid integer " + strconv.Quote(value))
+		}
+		field.value.SetInt(int64(number))
+	default:
+		field.value.SetString(strings.TrimSpace(value))
+	}
+	return nil
+}
+
+// Parses a duration expressed in seconds (e.g. 30) or as a Go duration (e.g. 30s, 1m30s)
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (c *Config) logSummary() {
+	log.Println("Federator environment mode: " + c.AppEnv)
+	if c.IsEntrypoint {
+		log.Println("ENTRYPOINT MODE")
+	}
+	if c.EphemeralDomain {
+		log.Println("EPHEMERAL DOMAIN MODE: the domain will leave the continuum on shutdown")
+	}
+	if c.CbToken.Mode == "keycloak" {
+		log.Println("Context Broker Authorization token mode: keycloak (" + c.CbToken.OAuthClientAuthMethod + ")")
+	} else {
+		log.Println("Context Broker Authorization token mode: " + c.CbToken.Mode)
+	}
+	log.Println("Domain lease renewed every " + c.Lease.RenewalInterval.String() + ", expiring after " + c.Lease.Duration.String() + " (expiry check mode: " + c.Lease.ExpiryCheck + ")")
+}
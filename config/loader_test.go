@@ -0,0 +1,253 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse-aerios/federator/models"
+)
+
+const testConfigFile = `appEnv: production
+isEntrypoint: true
+domain:
+  name: Domain01
+  owner: Owner01
+  publicUrl: http://domain01.example.org
+  cbUrl: http://orion:1026
+  cbHealthUrl: orion:1026
+cbToken:
+  aeriosShimUrl: http://shim:8080
+circuitBreaker:
+  failureThreshold: 7
+`
+
+// Writes a file in the temporary directory of the test and returns its path
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Unsets the env vars read by the tests, so the environment of the process doesn't change their results
+func clearTestEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{CONFIG_FILE_ENV_VAR, ENV_FILE_ENV_VAR, "APP_ENV", "CIRCUIT_BREAKER_FAILURE_THRESHOLD", "DOMAIN_NAME"} {
+		// Setenv restores the previous value at the end of the test
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		envFile string
+		flags   []string
+		want    int
+	}{
+		{name: "default", file: strings.Replace(testConfigFile, "  failureThreshold: 7\n", "", 1), want: 5},
+		{name: "config file over default", file: testConfigFile, want: 7},
+		{name: "env file over config file", file: testConfigFile, envFile: "CIRCUIT_BREAKER_FAILURE_THRESHOLD=9\n", want: 9},
+		{name: "env var over config file", file: testConfigFile, env: map[string]string{"CIRCUIT_BREAKER_FAILURE_THRESHOLD": "8"}, want: 8},
+		{
+			name:    "env var over env file",
+			file:    testConfigFile,
+			env:     map[string]string{"CIRCUIT_BREAKER_FAILURE_THRESHOLD": "8"},
+			envFile: "CIRCUIT_BREAKER_FAILURE_THRESHOLD=9\n",
+			want:    8,
+		},
+		{
+			name:  "flag over env var",
+			file:  testConfigFile,
+			env:   map[string]string{"CIRCUIT_BREAKER_FAILURE_THRESHOLD": "8"},
+			flags: []string{"--circuit-breaker-failure-threshold", "10"},
+			want:  10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearTestEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := []string{"--config", writeTestFile(t, "config.yaml", tt.file)}
+			if tt.envFile != "" {
+				args = append(args, "--env-file", writeTestFile(t, ".env", tt.envFile))
+			}
+			cfg, err := Load(append(args, tt.flags...))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.CircuitBreaker.FailureThreshold != tt.want {
+				t.Errorf("got failure threshold %d, want %d", cfg.CircuitBreaker.FailureThreshold, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadEnvFileSetsConfigFile(t *testing.T) {
+	clearTestEnv(t)
+	configFile := writeTestFile(t, "config.yaml", testConfigFile)
+	envFile := writeTestFile(t, ".env", CONFIG_FILE_ENV_VAR+"="+configFile+"\nDOMAIN_NAME=Domain 02\n")
+
+	cfg, err := Load([]string{"--env-file", envFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.File() != configFile {
+		t.Errorf("got config file %q, want %q", cfg.File(), configFile)
+	}
+	if cfg.Domain.Name != "Domain02" {
+		t.Errorf("got domain name %q, want Domain02", cfg.Domain.Name)
+	}
+	if _, isSet := os.LookupEnv("DOMAIN_NAME"); isSet {
+		t.Error("the env file must not change the environment of the process")
+	}
+}
+
+func TestLoadInvalidValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		want  []string
+	}{
+		{name: "invalid integer", flags: []string{"--circuit-breaker-failure-threshold", "many"}, want: []string{"--circuit-breaker-failure-threshold: invalid integer"}},
+		{name: "invalid duration", flags: []string{"--circuit-breaker-cooldown", "soon"}, want: []string{"--circuit-breaker-cooldown: invalid duration"}},
+		{
+			name:  "all the errors at once",
+			flags: []string{"--app-port", "0", "--domain-cb-url", "orion"},
+			want:  []string{"APP_PORT: invalid TCP port", "DOMAIN_CB_URL: invalid URL"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearTestEnv(t)
+			args := append([]string{"--config", writeTestFile(t, "config.yaml", testConfigFile)}, tt.flags...)
+			_, err := Load(args)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
+
+// Returns a valid configuration, to be modified by each test case
+func validTestConfig() *Config {
+	cfg := Default()
+	cfg.IsEntrypoint = true
+	cfg.Domain.Name = "Domain01"
+	cfg.Domain.Owner = "Owner01"
+	cfg.Domain.PublicUrl = "http://domain01.example.org"
+	cfg.Domain.CbUrl = "http://orion:1026"
+	cfg.Domain.CbHealthUrl = "orion:1026"
+	cfg.CbToken.AeriosShimUrl = "http://shim:8080"
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   []string
+	}{
+		{name: "valid", modify: func(cfg *Config) {}},
+		{
+			name: "required fields",
+			modify: func(cfg *Config) {
+				cfg.Domain.Name = ""
+				cfg.Domain.Owner = ""
+			},
+			want: []string{"DOMAIN_NAME: is required", "DOMAIN_OWNER: is required"},
+		},
+		{
+			name: "peer required unless entrypoint",
+			modify: func(cfg *Config) {
+				cfg.IsEntrypoint = false
+			},
+			want: []string{"PEER_FEDERATOR_URL: is required"},
+		},
+		{
+			name: "socket health check needs host and port",
+			modify: func(cfg *Config) {
+				cfg.Domain.CbHealthUrl = "http://orion:1026/version"
+			},
+			want: []string{"DOMAIN_CB_HEALTH_URL: invalid address"},
+		},
+		{
+			name: "lease shorter than its renewal",
+			modify: func(cfg *Config) {
+				cfg.Lease.Duration = cfg.Lease.RenewalInterval
+			},
+			want: []string{"DOMAIN_LEASE_DURATION: must be greater than DOMAIN_LEASE_RENEWAL_INTERVAL"},
+		},
+		{
+			name: "durations below 1s",
+			modify: func(cfg *Config) {
+				cfg.CircuitBreaker.Cooldown = 500 * time.Millisecond
+			},
+			want: []string{"CIRCUIT_BREAKER_COOLDOWN: must be at least 1s"},
+		},
+		{
+			name: "exclusive shared entity type without attributes",
+			modify: func(cfg *Config) {
+				cfg.Domain.SharedEntityTypes = []models.SharedEntityType{{EntityType: "Service", Mode: models.EXCLUSIVE_CSR_MODE}}
+			},
+			want: []string{"DOMAIN_SHARED_ENTITY_TYPES[0]: the exclusive mode requires the propertyNames or the relationshipNames"},
+		},
+		{
+			name: "invalid CSR templates",
+			modify: func(cfg *Config) {
+				cfg.CsrTemplates = []models.CSRTemplate{
+					{IdSuffix: "services", EntityTypes: []string{"Service"}, Operations: []string{"retrieveOps"}, Mode: models.EXCLUSIVE_CSR_MODE},
+					{IdSuffix: "nodes~1", EntityTypes: []string{"InfrastructureElement"}, Operations: []string{"retrieveOps"}, Mode: "shared"},
+				}
+			},
+			want: []string{
+				"CSR_TEMPLATES[services]: the exclusive mode of Service requires its attributes in entityTypeAttributes",
+				"CSR_TEMPLATES[nodes~1]: the idSuffix cannot contain ~",
+				"CSR_TEMPLATES[nodes~1]: invalid mode \"shared\"",
+			},
+		},
+		{
+			name: "duplicated sharing policy rules",
+			modify: func(cfg *Config) {
+				cfg.SharingPolicy.Rules = []models.SharingRule{{Name: "deny-all", Effect: "deny"}, {Name: "deny-all", Effect: "block"}}
+			},
+			want: []string{"SHARING_POLICY.rules[deny-all]: duplicated rule name", "SHARING_POLICY.rules[deny-all]: invalid effect \"block\""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validTestConfig()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't contain %q", err.Error(), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"crypto/sha256"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse-aerios/federator/models"
+)
+
+const RELOAD_HISTORY_SIZE = 20
+
+var reloadReasons = map[string]string{
+	"identity": "it is part of the identity of the domain in the continuum (Domain entity and CSRs of the other domains), so the domain must leave and join again",
+	"startup":  "it is only applied when the Federator starts, so a restart is needed",
+}
+
+// Holds the current configuration, which can be hot reloaded from the same sources it was loaded from
+// (config file, env vars and flags). Reloads changing any field that is not safe to change at runtime
+// are rejected as a whole, so the running configuration is always consistent.
+type Store struct {
+	args     []string
+	current  atomic.Pointer[Config]
+	mutex    sync.Mutex
+	hooks    []func(previous *Config, current *Config)
+	outcomes []models.ConfigReloadOutcome
+}
+
+func NewStore(cfg *Config, args []string) *Store {
+	store := &Store{args: args}
+	store.current.Store(cfg)
+	return store
+}
+
+// Returns the current configuration, which must not be modified
+func (s *Store) Get() *Config {
+	return s.current.Load()
+}
+
+// Registers a function called after each applied reload
+func (s *Store) OnReload(hook func(previous *Config, current *Config)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hooks = append(s.hooks, hook)
+}
+
+// Loads the configuration again and applies it if it is valid and only safe fields have changed
+func (s *Store) Reload(trigger string) models.ConfigReloadOutcome {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	log.Println("Reloading the configuration (" + trigger + ")...")
+	outcome := models.ConfigReloadOutcome{
+		Trigger: trigger,
+		Time:    time.Now(),
+	}
+
+	previous := s.Get()
+	next, err := Load(s.args)
+	if err != nil {
+		outcome.Result = models.CONFIG_RELOAD_FAILED
+		outcome.Errors = strings.Split(err.Error(), "\n")
+		log.Println("The configuration cannot be reloaded: " + strings.Join(outcome.Errors, "; "))
+		return s.record(outcome)
+	}
+
+	previousFields := configFields(reflect.ValueOf(previous).Elem())
+	nextFields := configFields(reflect.ValueOf(next).Elem())
+	for i, field := range nextFields {
+		if reflect.DeepEqual(field.value.Interface(), previousFields[i].value.Interface()) {
+			continue
+		}
+		outcome.ChangedFields = append(outcome.ChangedFields, field.env)
+		if field.reload != "" {
+			reason := reloadReasons[field.reload]
+			outcome.RejectedFields = append(outcome.RejectedFields, models.RejectedConfigField{Field: field.env, Reason: reason})
+			log.Println(field.env + " cannot be changed at runtime: " + reason)
+		}
+	}
+
+	switch {
+	case len(outcome.ChangedFields) == 0:
+		outcome.Result = models.CONFIG_RELOAD_UNCHANGED
+		log.Println("The configuration has not changed")
+	case len(outcome.RejectedFields) > 0:
+		outcome.Result = models.CONFIG_RELOAD_REJECTED
+		log.Println("Configuration reload rejected, the running configuration is kept")
+	default:
+		outcome.Result = models.CONFIG_RELOAD_APPLIED
+		s.current.Store(next)
+		log.Println("Configuration reloaded, changed fields: " + strings.Join(outcome.ChangedFields, ", "))
+		for _, hook := range s.hooks {
+			hook(previous, next)
+		}
+	}
+	return s.record(outcome)
+}
+
+func (s *Store) record(outcome models.ConfigReloadOutcome) models.ConfigReloadOutcome {
+	s.outcomes = append(s.outcomes, outcome)
+	if len(s.outcomes) > RELOAD_HISTORY_SIZE {
+		s.outcomes = s.outcomes[len(s.outcomes)-RELOAD_HISTORY_SIZE:]
+	}
+	return outcome
+}
+
+// Returns the outcomes of the last reloads, the most recent one first
+func (s *Store) ReloadStatus() models.ConfigReloadStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := models.ConfigReloadStatus{
+		ConfigFile: s.Get().File(),
+		History:    make([]models.ConfigReloadOutcome, 0, len(s.outcomes)),
+	}
+	for i := len(s.outcomes) - 1; i >= 0; i-- {
+		status.History = append(status.History, s.outcomes[i])
+	}
+	if len(status.History) > 0 {
+		status.LastOutcome = &status.History[0]
+	}
+	return status
+}
+
+// Polls the config file and the CSR templates file (if any) and reloads the configuration when their content
+// changes. The content is compared instead of the modification time, so the symlink swaps of mounted
+// ConfigMaps are also detected. The polling is run by the given scheduler (the background tasks of the
+// Federator), so it is stopped along with them.
+func (s *Store) WatchFile(every func(interval func() time.Duration, runFirst bool, task func())) {
+	files := s.Get().WatchedFiles()
+	if len(files) == 0 {
+		return
+	}
+	log.Println("Watching the configuration files " + strings.Join(files, ", ") + " for changes")
+	lastHash := filesHash(files)
+	every(func() time.Duration { return s.Get().ConfigWatchInterval }, false, func() {
+		hash := filesHash(s.Get().WatchedFiles())
+		if hash == nil || (lastHash != nil && *hash == *lastHash) {
+			return
+		}
+		lastHash = hash
+		s.Reload("config file change")
+	})
+}
+
+func filesHash(paths []string) *[sha256.Size]byte {
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		hash.Write([]byte(path))
+		hash.Write(data)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return &sum
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/eclipse-aerios/federator/models"
+)
+
+func TestStoreReload(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		result   string
+		rejected []string
+		applied  bool
+	}{
+		{name: "unchanged", file: testConfigFile, result: models.CONFIG_RELOAD_UNCHANGED},
+		{
+			name:    "safe field",
+			file:    strings.Replace(testConfigFile, "failureThreshold: 7", "failureThreshold: 3", 1),
+			result:  models.CONFIG_RELOAD_APPLIED,
+			applied: true,
+		},
+		{
+			name:     "identity field",
+			file:     strings.Replace(testConfigFile, "name: Domain01", "name: Domain02", 1),
+			result:   models.CONFIG_RELOAD_REJECTED,
+			rejected: []string{"DOMAIN_NAME"},
+		},
+		{
+			name:     "startup field",
+			file:     testConfigFile + "appPort: \"8051\"\n",
+			result:   models.CONFIG_RELOAD_REJECTED,
+			rejected: []string{"APP_PORT"},
+		},
+		{
+			name:     "safe and identity fields",
+			file:     strings.Replace(strings.Replace(testConfigFile, "failureThreshold: 7", "failureThreshold: 3", 1), "owner: Owner01", "owner: Owner02", 1),
+			result:   models.CONFIG_RELOAD_REJECTED,
+			rejected: []string{"DOMAIN_OWNER"},
+		},
+		{
+			name:   "invalid configuration",
+			file:   strings.Replace(testConfigFile, "failureThreshold: 7", "failureThreshold: 0", 1),
+			result: models.CONFIG_RELOAD_FAILED,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearTestEnv(t)
+			configFile := writeTestFile(t, "config.yaml", testConfigFile)
+			args := []string{"--config", configFile}
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			store := NewStore(cfg, args)
+			hookCalled := false
+			store.OnReload(func(previous *Config, current *Config) { hookCalled = true })
+
+			if err := os.WriteFile(configFile, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			outcome := store.Reload("test")
+
+			if outcome.Result != tt.result {
+				t.Errorf("got result %q, want %q (errors: %v)", outcome.Result, tt.result, outcome.Errors)
+			}
+			var rejected []string
+			for _, field := range outcome.RejectedFields {
+				rejected = append(rejected, field.Field)
+			}
+			if !slices.Equal(rejected, tt.rejected) {
+				t.Errorf("got rejected fields %v, want %v", rejected, tt.rejected)
+			}
+			if hookCalled != tt.applied {
+				t.Errorf("got hook called %t, want %t", hookCalled, tt.applied)
+			}
+			if (store.Get() != cfg) == !tt.applied {
+				t.Errorf("the running configuration must only be replaced by an applied reload")
+			}
+			if status := store.ReloadStatus(); status.LastOutcome == nil || status.LastOutcome.Result != tt.result {
+				t.Errorf("the reload status doesn't report the last outcome")
+			}
+		})
+	}
+}
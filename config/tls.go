@@ -0,0 +1,28 @@
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// Returns the system CAs plus the ones of the given PEM bundles
+func LoadCaBundle(files ...string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.New("cannot read the CA bundle: " + err.Error())
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no PEM certificates found in the CA bundle " + file)
+		}
+	}
+	return pool, nil
+}
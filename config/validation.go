@@ -0,0 +1,311 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eclipse-aerios/federator/models"
+)
+
+// Validates the configuration, returning all the missing or invalid fields at once
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(field string, message string) {
+		errs = append(errs, errors.New(field+": "+message))
+	}
+	required := func(field string, value string) bool {
+		if value == "" {
+			invalid(field, "is required")
+			return false
+		}
+		return true
+	}
+	validUrl := func(field string, value string) {
+		if !isValidUrl(value) {
+			invalid(field, "invalid URL "+strconv.Quote(value)+" (an absolute http or https URL is expected)")
+		}
+	}
+	minDuration := func(field string, value time.Duration) {
+		if value < time.Second {
+			invalid(field, "must be at least 1s (got "+value.String()+")")
+		}
+	}
+	positive := func(field string, value int) {
+		if value <= 0 {
+			invalid(field, "must be a positive integer (got "+strconv.Itoa(value)+")")
+		}
+	}
+
+	if port, err := strconv.Atoi(c.AppPort); err != nil || port <= 0 || port > 65535 {
+		invalid("APP_PORT", "invalid TCP port "+strconv.Quote(c.AppPort))
+	}
+
+	required("DOMAIN_NAME", c.Domain.Name)
+	required("DOMAIN_OWNER", c.Domain.Owner)
+	if required("DOMAIN_PUBLIC_URL", c.Domain.PublicUrl) {
+		validUrl("DOMAIN_PUBLIC_URL", c.Domain.PublicUrl)
+	}
+	if required("DOMAIN_CB_URL", c.Domain.CbUrl) {
+		validUrl("DOMAIN_CB_URL", c.Domain.CbUrl)
+	}
+	if c.Domain.FederatorUrl != "" {
+		validUrl("DOMAIN_FEDERATOR_URL", c.Domain.FederatorUrl)
+	}
+	if c.Domain.BrokerUrl != "" {
+		validUrl("DOMAIN_BROKER_URL", c.Domain.BrokerUrl)
+	}
+	for i, shared := range c.Domain.SharedEntityTypes {
+		if shared.EntityType == "" {
+			invalid("DOMAIN_SHARED_ENTITY_TYPES["+strconv.Itoa(i)+"]", "the entityType is required")
+		}
+		if shared.Mode != "" && !slices.Contains(CSR_MODES, shared.Mode) {
+			invalid("DOMAIN_SHARED_ENTITY_TYPES["+strconv.Itoa(i)+"]", "invalid mode "+strconv.Quote(shared.Mode)+" ("+strings.Join(CSR_MODES, ", ")+")")
+		} else if shared.Mode == models.EXCLUSIVE_CSR_MODE && !shared.HasAttributes() {
+			invalid("DOMAIN_SHARED_ENTITY_TYPES["+strconv.Itoa(i)+"]", "the exclusive mode requires the propertyNames or the relationshipNames")
+		}
+	}
+	if c.Domain.Location != nil {
+		if !slices.Contains(models.GEOMETRY_TYPES, c.Domain.Location.Type) {
+			invalid("DOMAIN_LOCATION", "invalid GeoJSON geometry type "+strconv.Quote(c.Domain.Location.Type)+" ("+strings.Join(models.GEOMETRY_TYPES, ", ")+")")
+		} else if c.Domain.Location.Coordinates == nil {
+			invalid("DOMAIN_LOCATION", "the coordinates of the geometry are required")
+		}
+	}
+	if c.IsEntrypoint {
+		if c.PeerFederatorUrl != "" {
+			validUrl("PEER_FEDERATOR_URL", c.PeerFederatorUrl)
+		}
+		if c.EphemeralDomain {
+			invalid("EPHEMERAL_DOMAIN", "the entrypoint domain cannot be an ephemeral domain")
+		}
+	} else if required("PEER_FEDERATOR_URL", c.PeerFederatorUrl) {
+		validUrl("PEER_FEDERATOR_URL", c.PeerFederatorUrl)
+	}
+
+	if !slices.Contains(CB_TYPES, c.CbType) {
+		invalid("CB_TYPE", "invalid context broker "+strconv.Quote(c.CbType)+" ("+strings.Join(CB_TYPES, ", ")+")")
+	}
+	if c.AeriosContextUrl != "" {
+		validUrl("AERIOS_CONTEXT_URL", c.AeriosContextUrl)
+	}
+	switch c.CbHealthCheckMode {
+	case "endpoint":
+	case "socket":
+		// The TCP socket health check needs host:port, not a URL
+		if required("DOMAIN_CB_HEALTH_URL", c.Domain.CbHealthUrl) {
+			if _, _, err := net.SplitHostPort(c.Domain.CbHealthUrl); err != nil {
+				invalid("DOMAIN_CB_HEALTH_URL", "invalid address "+strconv.Quote(c.Domain.CbHealthUrl)+" (host:port is expected in socket mode)")
+			}
+		}
+	default:
+		invalid("CB_HEALTH_CHECK_MODE", "invalid mode "+strconv.Quote(c.CbHealthCheckMode)+" (endpoint or socket)")
+	}
+
+	// The settings of the auth profiles are reported with the name of the profile as prefix
+	validateToken := func(prefix string, token CbTokenConfig) {
+		switch token.Mode {
+		case "shim":
+			if required(prefix+"AERIOS_SHIM_URL", token.AeriosShimUrl) {
+				validUrl(prefix+"AERIOS_SHIM_URL", token.AeriosShimUrl)
+			}
+		case "static":
+			required(prefix+"CB_STATIC_TOKEN", token.StaticToken)
+		case "file":
+			required(prefix+"CB_TOKEN_FILE", token.TokenFile)
+		case "keycloak":
+			required(prefix+"CB_OAUTH_CLIENT_ID", token.OAuthClientId)
+			switch token.OAuthClientAuthMethod {
+			case "client_secret":
+				required(prefix+"CB_OAUTH_CLIENT_SECRET", token.OAuthClientSecret)
+			case "private_key_jwt":
+				if required(prefix+"CB_OAUTH_PRIVATE_KEY_FILE", token.OAuthPrivateKeyFile) {
+					if _, err := os.Stat(token.OAuthPrivateKeyFile); err != nil {
+						invalid(prefix+"CB_OAUTH_PRIVATE_KEY_FILE", "cannot read the private key: "+err.Error())
+					}
+				}
+			default:
+				invalid(prefix+"CB_OAUTH_CLIENT_AUTH_METHOD", "invalid method "+strconv.Quote(token.OAuthClientAuthMethod)+" (client_secret or private_key_jwt)")
+			}
+			required(prefix+"KEYCLOAK_REALM", token.KeycloakRealm)
+			if required(prefix+"KEYCLOAK_URL", token.KeycloakUrl) {
+				validUrl(prefix+"KEYCLOAK_URL", token.KeycloakUrl)
+			}
+		default:
+			invalid(prefix+"CB_TOKEN_MODE", "invalid mode "+strconv.Quote(token.Mode)+" (shim, keycloak, static or file)")
+		}
+		minDuration(prefix+"CB_TOKEN_REFRESH_MARGIN", token.RefreshMargin)
+	}
+
+	validateToken("", c.CbToken)
+	profileNames := make(map[string]bool)
+	for i, profile := range c.AuthProfiles {
+		if profile.Name == "" {
+			invalid("AUTH_PROFILES["+strconv.Itoa(i)+"]", "the name of the profile is required")
+			continue
+		}
+		prefix := "AUTH_PROFILES[" + profile.Name + "]."
+		if profileNames[profile.Name] {
+			invalid("AUTH_PROFILES["+profile.Name+"]", "duplicated profile name")
+		}
+		profileNames[profile.Name] = true
+		if len(profile.Domains) == 0 && len(profile.UrlPatterns) == 0 {
+			invalid("AUTH_PROFILES["+profile.Name+"]", "at least one domain or URL pattern is required")
+		}
+		validateToken(prefix, profile.Token)
+	}
+
+	if _, err := LoadCaBundle(c.Tls.CaFile); err != nil {
+		invalid("TLS_CA_FILE", err.Error())
+	}
+	if (c.Tls.ClientCertFile == "") != (c.Tls.ClientKeyFile == "") {
+		invalid("TLS_CLIENT_CERT_FILE", "the client certificate and TLS_CLIENT_KEY_FILE must be set together")
+	} else if c.Tls.ClientCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.Tls.ClientCertFile, c.Tls.ClientKeyFile); err != nil {
+			invalid("TLS_CLIENT_CERT_FILE", "cannot load the client certificate: "+err.Error())
+		}
+	}
+	overrideNames := make(map[string]bool)
+	for i, override := range c.Tls.Overrides {
+		if override.Name == "" {
+			invalid("TLS_OVERRIDES["+strconv.Itoa(i)+"]", "the name of the override is required")
+			continue
+		}
+		field := "TLS_OVERRIDES[" + override.Name + "]"
+		if overrideNames[override.Name] {
+			invalid(field, "duplicated override name")
+		}
+		overrideNames[override.Name] = true
+		if len(override.Domains) == 0 && len(override.UrlPatterns) == 0 {
+			invalid(field, "at least one domain or URL pattern is required")
+		}
+		if _, err := LoadCaBundle(override.CaFile); err != nil {
+			invalid(field+".caFile", err.Error())
+		}
+	}
+
+	if len(c.CsrTemplates) == 0 {
+		invalid("CSR_TEMPLATES", "at least one CSR template is required")
+	}
+	templateIds := make(map[string]bool)
+	for i, template := range c.CsrTemplates {
+		if template.IdSuffix == "" {
+			invalid("CSR_TEMPLATES["+strconv.Itoa(i)+"]", "the idSuffix of the template is required")
+			continue
+		}
+		field := "CSR_TEMPLATES[" + template.IdSuffix + "]"
+		if strings.Contains(template.IdSuffix, models.CSR_REVISION_SEPARATOR) {
+			invalid(field, "the idSuffix cannot contain "+models.CSR_REVISION_SEPARATOR+", which separates the revisions of the CSR ids")
+		}
+		if templateIds[template.IdSuffix] {
+			invalid(field, "duplicated idSuffix")
+		}
+		templateIds[template.IdSuffix] = true
+		if len(template.EntityTypes) == 0 {
+			invalid(field, "at least one entity type is required")
+		}
+		if len(template.Operations) == 0 {
+			invalid(field, "at least one operation is required")
+		}
+		if !slices.Contains(CSR_MODES, template.Mode) {
+			invalid(field, "invalid mode "+strconv.Quote(template.Mode)+" ("+strings.Join(CSR_MODES, ", ")+")")
+		}
+		modeEntityTypes := make([]string, 0, len(template.EntityTypeModes))
+		for entityType := range template.EntityTypeModes {
+			modeEntityTypes = append(modeEntityTypes, entityType)
+		}
+		slices.Sort(modeEntityTypes)
+		for _, entityType := range modeEntityTypes {
+			mode := template.EntityTypeModes[entityType]
+			if !slices.Contains(template.EntityTypes, entityType) {
+				invalid(field+".entityTypeModes", "the entity type "+entityType+" is not registered by the template")
+			} else if !slices.Contains(CSR_MODES, mode) {
+				invalid(field+".entityTypeModes", "invalid mode "+strconv.Quote(mode)+" of "+entityType+" ("+strings.Join(CSR_MODES, ", ")+")")
+			}
+		}
+		attributesEntityTypes := make([]string, 0, len(template.EntityTypeAttributes))
+		for entityType := range template.EntityTypeAttributes {
+			attributesEntityTypes = append(attributesEntityTypes, entityType)
+		}
+		slices.Sort(attributesEntityTypes)
+		for _, entityType := range attributesEntityTypes {
+			if !slices.Contains(template.EntityTypes, entityType) {
+				invalid(field+".entityTypeAttributes", "the entity type "+entityType+" is not registered by the template")
+			}
+		}
+		for _, entityType := range template.EntityTypes {
+			mode, isSet := template.EntityTypeModes[entityType]
+			if !isSet {
+				mode = template.Mode
+			}
+			if mode == models.EXCLUSIVE_CSR_MODE && !template.HasAttributes(entityType) {
+				invalid(field, "the exclusive mode of "+entityType+" requires its attributes in entityTypeAttributes")
+			}
+		}
+		if template.EndpointPath != "" && !strings.HasPrefix(template.EndpointPath, "/") {
+			invalid(field, "the endpointPath must start with /")
+		}
+	}
+
+	if c.SharingPolicy.DefaultEffect != "" && !slices.Contains(models.SHARING_EFFECTS, c.SharingPolicy.DefaultEffect) {
+		invalid("SHARING_POLICY.defaultEffect", "invalid effect "+strconv.Quote(c.SharingPolicy.DefaultEffect)+" (allow or deny)")
+	}
+	ruleNames := make(map[string]bool)
+	for i, rule := range c.SharingPolicy.Rules {
+		if rule.Name == "" {
+			invalid("SHARING_POLICY.rules["+strconv.Itoa(i)+"]", "the name of the rule is required")
+			continue
+		}
+		field := "SHARING_POLICY.rules[" + rule.Name + "]"
+		if ruleNames[rule.Name] {
+			invalid(field, "duplicated rule name")
+		}
+		ruleNames[rule.Name] = true
+		if !slices.Contains(models.SHARING_EFFECTS, rule.Effect) {
+			invalid(field, "invalid effect "+strconv.Quote(rule.Effect)+" (allow or deny)")
+		}
+	}
+	minDuration("SHARING_RECONCILE_INTERVAL", c.SharingReconcileInterval)
+
+	minDuration("DOMAIN_LEASE_RENEWAL_INTERVAL", c.Lease.RenewalInterval)
+	minDuration("DOMAIN_LEASE_DURATION", c.Lease.Duration)
+	if c.Lease.Duration <= c.Lease.RenewalInterval {
+		invalid("DOMAIN_LEASE_DURATION", "must be greater than DOMAIN_LEASE_RENEWAL_INTERVAL")
+	}
+	if c.Lease.ExpiryCheck != "entrypoint" && c.Lease.ExpiryCheck != "all" && c.Lease.ExpiryCheck != "none" {
+		invalid("DOMAIN_LEASE_EXPIRY_CHECK", "invalid mode "+strconv.Quote(c.Lease.ExpiryCheck)+" (entrypoint, all or none)")
+	}
+	minDuration("CSR_LEASE_RENEWAL_INTERVAL", c.CsrLease.RenewalInterval)
+	minDuration("CSR_LEASE_DURATION", c.CsrLease.Duration)
+	if c.CsrLease.Duration <= c.CsrLease.RenewalInterval {
+		invalid("CSR_LEASE_DURATION", "must be greater than CSR_LEASE_RENEWAL_INTERVAL")
+	}
+	minDuration("HEALTH_MONITOR_INTERVAL", c.HealthMonitor.Interval)
+	positive("HEALTH_MONITOR_FAILURE_THRESHOLD", c.HealthMonitor.FailureThreshold)
+	positive("SHADOW_JOIN_PROMOTION_CHECKS", c.ShadowJoin.PromotionChecks)
+	positive("CIRCUIT_BREAKER_FAILURE_THRESHOLD", c.CircuitBreaker.FailureThreshold)
+	minDuration("CIRCUIT_BREAKER_COOLDOWN", c.CircuitBreaker.Cooldown)
+	minDuration("OUTBOX_RETRY_INTERVAL", c.Outbox.RetryInterval)
+	positive("OUTBOX_MAX_ATTEMPTS", c.Outbox.MaxAttempts)
+	minDuration("INIT_RETRY_INITIAL_BACKOFF", c.Initialization.RetryInitialBackoff)
+	minDuration("INIT_RETRY_MAX_BACKOFF", c.Initialization.RetryMaxBackoff)
+	if c.Initialization.RetryMaxBackoff < c.Initialization.RetryInitialBackoff {
+		invalid("INIT_RETRY_MAX_BACKOFF", "must not be lower than INIT_RETRY_INITIAL_BACKOFF")
+	}
+	minDuration("READINESS_CHECK_INTERVAL", c.ReadinessCheckInterval)
+	minDuration("SHUTDOWN_TIMEOUT", c.ShutdownTimeout)
+	minDuration("CONFIG_WATCH_INTERVAL", c.ConfigWatchInterval)
+
+	return errors.Join(errs...)
+}
+
+func isValidUrl(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type AdminController struct {
+	store     *config.Store
+	federator *utils.Federator
+}
+
+func NewAdminController(store *config.Store, federator *utils.Federator) *AdminController {
+	return &AdminController{store: store, federator: federator}
+}
+
+// Returns the outcomes of the last hot reloads of the configuration
+func (a *AdminController) ConfigReloads(c *gin.Context) {
+	c.JSON(http.StatusOK, a.store.ReloadStatus())
+}
+
+// Reloads the configuration on demand, as a SIGHUP or a change of the config file do
+func (a *AdminController) ReloadConfig(c *gin.Context) {
+	outcome := a.store.Reload("admin API")
+	switch outcome.Result {
+	case models.CONFIG_RELOAD_FAILED:
+		c.JSON(http.StatusBadRequest, outcome)
+	case models.CONFIG_RELOAD_REJECTED:
+		c.JSON(http.StatusConflict, outcome)
+	default:
+		c.JSON(http.StatusOK, outcome)
+	}
+}
+
+// Returns the domains in shadow mode, along with the results of their federated query checks
+func (a *AdminController) ShadowDomains(c *gin.Context) {
+	c.JSON(http.StatusOK, a.federator.State.ShadowDomains())
+}
+
+// Promotes a domain out of the shadow mode, replacing its auxiliary CSRs with the regular ones
+func (a *AdminController) PromoteShadowDomain(c *gin.Context) {
+	domain := c.Param("domainName")
+	err := a.federator.ShadowDomains.Promote(domain)
+	if err != nil {
+		log.Println(err)
+		if strings.HasPrefix(err.Error(), strconv.Itoa(http.StatusNotFound)) {
+			c.JSON(http.StatusNotFound, gin.H{"message": "The domain " + domain + " is not in shadow mode"})
+		} else {
+			c.JSON(http.StatusBadGateway, gin.H{"message": "The domain " + domain + " cannot be promoted: " + err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Domain " + domain + " successfully promoted"})
+}
@@ -1,31 +1,64 @@
 package controllers
 
 import (
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/models"
 	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/state"
+	"github.com/eclipse-aerios/federator/utils"
 	"github.com/gin-gonic/gin"
 )
 
 type DomainController struct {
+	store        *config.Store
 	orionSvc     services.OrionldSvc
 	federatorSvc services.FederatorSvc
+	federator    *utils.Federator
+}
+
+func NewDomainController(store *config.Store, orionSvc services.OrionldSvc, federatorSvc services.FederatorSvc, federator *utils.Federator) *DomainController {
+	return &DomainController{
+		store:        store,
+		orionSvc:     orionSvc,
+		federatorSvc: federatorSvc,
+		federator:    federator,
+	}
+}
+
+func (d *DomainController) cfg() *config.Config {
+	return d.store.Get()
 }
 
 func (d *DomainController) List(c *gin.Context) {
-	domains, _, err := d.orionSvc.GetDomainEntities("simplified", true, "publicUrl,domainStatus,isEntrypoint,publicKey,owner", "", "", "")
+	domains, _, err := d.orionSvc.GetDomainEntities("simplified", true, "publicUrl,domainStatus,isEntrypoint,federatorUrl,brokerUrl,tenant,publicKey,owner,sharedEntityTypes,labels,location", "", "", "")
 	if err != nil {
 		log.Println("Error when retrieving Domains")
 		log.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot retrieve continuum domains"})
 		return
 	}
+
+	// Domains disabled by this federator are shown as Disabled, including the ones whose CSRs are suspended
+	for i := range domains {
+		if d.federator.DisabledDomains.IsDisabled(models.GetNgsiLdEntityIdValue("Domain", domains[i].Id)) {
+			domains[i].DomainStatus = config.DISABLED_DOMAIN_STATUS
+		}
+	}
+	for _, disabledDomain := range d.federator.DisabledDomains.Entities() {
+		isListed := len(Filter(domains, func(domain models.DomainSimplified) bool { return domain.Id == disabledDomain.Id })) > 0
+		if !isListed {
+			disabledDomain.DomainStatus = config.DISABLED_DOMAIN_STATUS
+			domains = append(domains, disabledDomain)
+		}
+	}
 	c.JSON(http.StatusOK, domains)
 }
 
@@ -40,6 +73,18 @@ func (d *DomainController) GetLocalDomain(c *gin.Context) {
 	c.JSON(http.StatusOK, domain)
 }
 
+// Returns the entity types and operations accepted from each remote domain by the local sharing policy
+func (d *DomainController) Sharing(c *gin.Context) {
+	report, err := d.federator.Sharing.Report()
+	if err != nil {
+		log.Println("Error when retrieving Domains")
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot retrieve continuum domains"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
 func (d *DomainController) NewDomain(c *gin.Context) {
 	// Check spread parameter
 	spread, err := strconv.ParseBool(c.DefaultQuery("spread", "false"))
@@ -61,6 +106,16 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 		return
 	}
 	log.Println("New domain: " + newDomain.Name)
+	for _, shared := range newDomain.SharedEntityTypes {
+		if shared.Mode != "" && !slices.Contains(config.CSR_MODES, shared.Mode) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid mode " + strconv.Quote(shared.Mode) + " of the shared entity type " + shared.EntityType + ", the valid modes are " + strings.Join(config.CSR_MODES, ", ")})
+			return
+		}
+		if shared.Mode == models.EXCLUSIVE_CSR_MODE && !shared.HasAttributes() {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "The exclusive mode of the shared entity type " + shared.EntityType + " requires its propertyNames or relationshipNames"})
+			return
+		}
+	}
 
 	// TODO The receiver federator can also check if this domain is already present in the continuum
 
@@ -85,11 +140,15 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 		}
 		// Create CSR in the local broker
 		log.Println("Creating CSRs pointing to the new broker in the local broker...")
-		newRegistrations := d.orionSvc.GenerateContextSourceRegistrations(newDomain)
+		isNewShadowDomain := d.federator.ShadowDomains.Join(newDomain.Name)
+		newRegistrations := d.orionSvc.GenerateAcceptedContextSourceRegistrations(newDomain)
 		err = d.orionSvc.CreateContextSourceRegistrations(&newRegistrations)
 		if err != nil {
 			log.Println("Error when creating local CSRs")
 			log.Println(err)
+			if isNewShadowDomain {
+				d.federator.ShadowDomains.Forget(newDomain.Name)
+			}
 			if strings.Contains(err.Error(), "409") {
 				c.JSON(http.StatusConflict, &models.NewDomainSpreadResponse{Message: "The domain has been already registered in the domain's context broker"})
 			} else {
@@ -98,7 +157,7 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 			return
 		}
 
-		localDomainRegistrations := d.orionSvc.GenerateContextSourceRegistrations(config.LOCAL_DOMAIN)
+		localDomainRegistrations := d.orionSvc.GenerateContextSourceRegistrations(d.federator.State.LocalDomain(d.cfg()))
 
 		// Retrieve the filtered registrations (only aeriOS related and exclude the new broker itself) present in the local broker
 		localRegistrations, err := d.orionSvc.GetAeriosContextSourceRegistrations("aeriosDomain!=\""+newDomain.Name+"\"", true)
@@ -112,11 +171,11 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 		localRegistrations = append(localRegistrations, localDomainRegistrations...)
 
 		// Get domains
-		idPattern := "^(?!.*(" + models.BuildNgsiLdEntityId("Domain", newDomain.Name) + "|" + models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME) + ")).*$"
+		idPattern := "^(?!.*(" + models.BuildNgsiLdEntityId("Domain", newDomain.Name) + "|" + models.BuildNgsiLdEntityId("Domain", d.cfg().Domain.Name) + ")).*$"
 		// FIXME only functional domains
 		// domainsQuery := "domainStatus==\"" + config.FUNCTIONAL_DOMAIN_STATUS + "\""
 		domainsQuery := ""
-		domains, _, err := d.orionSvc.GetDomainEntities("simplified", true, "publicUrl,domainStatus,isEntrypoint,federatorUrl", domainsQuery, "", idPattern)
+		domains, _, err := d.orionSvc.GetDomainEntities("simplified", true, "publicUrl,domainStatus,isEntrypoint,federatorUrl,brokerUrl,tenant,owner,labels", domainsQuery, "", idPattern)
 		if err != nil {
 			log.Println("Error when retrieving Domains")
 			log.Println(err)
@@ -127,16 +186,17 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 		log.Println("Spreading the new domain...")
 		// Send new Domain requests (spread=false) to notify the other brokers
 		failedDomains := make([]string, 0)
+		queuedDomains := make([]string, 0)
 		for _, domain := range domains {
 			log.Println("Sending the new domain creation to domain -> " + domain.Id)
-			log.Println("POST request to " + domain.FederatorUrl + " pointing to domain " + domain.Id)
-
-			// Check if federatorUrl in domain entity, if not, use publicUrl + /federator
-			var federatorUrl string
-			if domain.FederatorUrl == "" {
-				federatorUrl = domain.PublicUrl + "/federator"
-			} else {
-				federatorUrl = domain.FederatorUrl
+			federatorUrl := domain.GetFederatorUrl()
+			log.Println("POST request to " + federatorUrl + " pointing to domain " + domain.Id)
+			// Don't wait for domains that are known to be down, the notification will be retried later
+			if d.federatorSvc.IsCircuitOpen(federatorUrl) {
+				log.Println("The circuit breaker of domain " + domain.Id + " is open, so the notification is queued in the retry outbox")
+				d.federator.RetryOutbox.EnqueueNewDomain(newDomain, domain.Id, federatorUrl)
+				queuedDomains = append(queuedDomains, domain.Id)
+				continue
 			}
 			// Notify the new domain addition to the domain federator and check the result
 			_, err = d.federatorSvc.NotifyNewDomain(newDomain, federatorUrl)
@@ -155,10 +215,14 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 			Domains:                domains,
 			NewDomainRegistrations: localRegistrations,
 			FailedDomains:          failedDomains,
+			QueuedDomains:          queuedDomains,
 			Message:                "Spreading operation completed",
 		}
 
-		if len(failedDomains) > 0 {
+		if len(queuedDomains) > 0 && len(failedDomains) == 0 {
+			response.Message = "Spreading operation completed, but the domain addition has been queued for some unreachable domains"
+			c.JSON(http.StatusMultiStatus, response)
+		} else if len(failedDomains) > 0 {
 			response.Message = "Spreading operation completed, but the domain addition has failed in some domains"
 			c.JSON(http.StatusMultiStatus, response)
 		} else {
@@ -168,11 +232,15 @@ func (d *DomainController) NewDomain(c *gin.Context) {
 		log.Println("NO SPREADING MODE")
 		// Create CSR in the local broker
 		log.Println("Creating CSRs pointing to the new broker in the local broker...")
-		newRegistrations := d.orionSvc.GenerateContextSourceRegistrations(newDomain)
+		isNewShadowDomain := d.federator.ShadowDomains.Join(newDomain.Name)
+		newRegistrations := d.orionSvc.GenerateAcceptedContextSourceRegistrations(newDomain)
 		err = d.orionSvc.CreateContextSourceRegistrations(&newRegistrations)
 		if err != nil {
 			log.Println("Error when creating local CSRs")
 			log.Println(err)
+			if isNewShadowDomain {
+				d.federator.ShadowDomains.Forget(newDomain.Name)
+			}
 			if strings.Contains(err.Error(), "409") {
 				c.JSON(http.StatusConflict, &models.NewDomainSpreadResponse{Message: "The domain has been already registered in the domain's context broker"})
 			} else {
@@ -207,8 +275,11 @@ func (d *DomainController) Delete(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot delete local CSRs"})
 		return
 	}
+	d.federator.DisabledDomains.Forget(domain)
+	d.federator.ShadowDomains.Forget(domain)
+	d.federator.KnownDomains.Forget(domain)
 
-	if domain == config.PeerFederatorDomain {
+	if domain == d.federator.State.Peer().Domain {
 		// Select another peer federator -> default entrypoint domain?
 		log.Println("Deleting the domain of the peer federator, so a new peer federator must be configured...")
 		domainsQuery := "isEntrypoint==true"
@@ -224,13 +295,12 @@ func (d *DomainController) Delete(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot retrieve continuum domains"})
 			return
 		}
-		if domains[0].FederatorUrl == "" {
-			config.PEER_FEDERATOR_URL = domains[0].PublicUrl + "/federator"
-		} else {
-			config.PEER_FEDERATOR_URL = domains[0].FederatorUrl
+		peer := state.Peer{
+			FederatorUrl: domains[0].GetFederatorUrl(),
+			Domain:       strings.ReplaceAll(domains[0].Id, "urn:ngsi-ld:Domain:", ""),
 		}
-		config.PeerFederatorDomain = strings.ReplaceAll(domains[0].Id, "urn:ngsi-ld:Domain:", "")
-		log.Println("The new peer federator is the entrypoint domain federator -> " + config.PeerFederatorDomain)
+		d.federator.State.SetPeer(peer)
+		log.Println("The new peer federator is the entrypoint domain federator -> " + peer.Domain)
 		// TODO this works, but what about if the federator dies? the former value from the env var will be used... -> need of an aux db
 	}
 
@@ -238,89 +308,20 @@ func (d *DomainController) Delete(c *gin.Context) {
 }
 
 func (d *DomainController) DeleteLocalDomain(c *gin.Context) {
-	// TODO solve in the future -> move the entrypoint domain?
-	if config.IS_ENTRYPOINT {
-		log.Println("The entrypoint domain cannot be deleted")
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "The entrypoint domain cannot be deleted"})
-		return
-	}
-
-	// Check if status is Removed
-	localDomain, err := d.orionSvc.GetLocalDomainEntity("simplified", "domainStatus", "")
-	if err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot retrieve domain status"})
-		return
-	}
-	if localDomain.DomainStatus == config.DELETED_DOMAIN_STATUS {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "The domain has already been removed"})
-		return
-	}
-
-	// Update Domain status to Removed
-	err = d.orionSvc.UpdateLocalDomainStatus(config.DELETED_DOMAIN_STATUS)
+	response, err := d.federator.LeaveContinuum()
 	if err != nil {
-		log.Println("Cannot update domain status to Removed")
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot update domain status to Removed"})
-		return
-	}
-
-	// Spread the domain deletion among the brokers of the continuum (it only must be done by the entrypoint or selected peer federator)
-	// FIXME only functional domains -> domainsQuery := "domainStatus==\"" + config.FUNCTIONAL_DOMAIN_STATUS + "\""
-	domainsQuery := ""
-	domains, _, err := d.orionSvc.GetDomainEntities("simplified", true, "publicUrl,domainStatus,federatorUrl", domainsQuery, "", "")
-	if err != nil {
-		log.Println("Error when retrieving Domains")
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot retrieve continuum domains"})
-		return
-	}
-
-	// Send delete Domain requests to notify the other brokers
-	failedDomains := make([]string, 0)
-	if len(domains) == 0 {
-		log.Println("No domains to spread the domain deletion")
-	}
-	for _, domain := range domains {
-		if domain.Id == models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME) {
-			continue
-		}
-		log.Println("Sending the domain deletion to domain " + domain.Id)
-		log.Println("DELETE request to " + domain.FederatorUrl + " pointing to domain " + domain.Id)
-
-		// If Federator URL is not included in the Domain entity, use publicUrl + "/federator"
-		var federatorUrl string
-		if domain.FederatorUrl == "" {
-			federatorUrl = domain.PublicUrl + "/federator"
+		var leaveErr *utils.LeaveError
+		if errors.As(err, &leaveErr) {
+			c.JSON(leaveErr.StatusCode, gin.H{"message": leaveErr.Message})
 		} else {
-			federatorUrl = domain.FederatorUrl
-		}
-		err = d.federatorSvc.NotifyDeletedDomain(config.DOMAIN_NAME, federatorUrl)
-		if err != nil {
-			log.Println(err)
-			log.Println("Cannot contant with the domain to spread the domain deletion")
-			failedDomains = append(failedDomains, domain.Id)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		}
-	}
-
-	// Delete CSR in the local broker
-	err = d.orionSvc.DeleteAeriosContextSourceRegistrations()
-	if err != nil {
-		log.Println("Cannot delete local CSRs")
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "Cannot delete local CSRs"})
 		return
 	}
 
-	response := &models.DeleteDomainSpreadResponse{
-		FailedDomains: failedDomains,
-		Message:       "",
-	}
-
-	if len(failedDomains) > 0 {
-		response.Message = "Local domain " + config.DOMAIN_NAME + " successfully deleted, but the deletion has failed in some domains"
+	if len(response.FailedDomains) > 0 || len(response.QueuedDomains) > 0 {
 		c.JSON(http.StatusMultiStatus, response)
 	} else {
-		response.Message = "Local domain " + config.DOMAIN_NAME + " successfully deleted"
 		c.JSON(http.StatusCreated, response)
 	}
 }
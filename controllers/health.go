@@ -3,33 +3,58 @@ package controllers
 import (
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/models"
 	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/utils"
 	"github.com/gin-gonic/gin"
 )
 
 type HealthController struct {
+	store        *config.Store
 	orionSvc     services.OrionldSvc
 	federatorSvc services.FederatorSvc
+	federator    *utils.Federator
+}
+
+func NewHealthController(store *config.Store, orionSvc services.OrionldSvc, federatorSvc services.FederatorSvc, federator *utils.Federator) *HealthController {
+	return &HealthController{
+		store:        store,
+		orionSvc:     orionSvc,
+		federatorSvc: federatorSvc,
+		federator:    federator,
+	}
+}
+
+func (h *HealthController) cfg() *config.Config {
+	return h.store.Get()
 }
 
 func (h *HealthController) Status(c *gin.Context) {
+	deep, err := strconv.ParseBool(c.DefaultQuery("deep", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Deep parameter must be boolean"})
+		return
+	}
+
 	// Local checks
 	/*** 1. Check if Orion-LD is reachable and healthy */
 	log.Println("Checking the health of Orion-LD...")
 	isOrionHealthy, err := h.orionSvc.IsOrionHealthy()
 	if !isOrionHealthy {
-		returnUnhealthyStatus(c, config.UNHEALTHY_STATUS, "", "", "Orion-LD of the domain is unhealthy", err.Error())
+		h.returnUnhealthyStatus(c, config.UNHEALTHY_STATUS, "", "", "Orion-LD of the domain is unhealthy", err.Error(), nil)
 		return
 	}
 
 	domain, err := h.orionSvc.GetLocalDomainEntity("simplified", "domainStatus", "")
 	if err != nil {
 		log.Println(err)
-		returnUnhealthyStatus(c, config.HEALTHY_STATUS, "", "", "Cannot retrieve local domain", err.Error())
+		h.returnUnhealthyStatus(c, config.HEALTHY_STATUS, "", "", "Cannot retrieve local domain", err.Error(), nil)
 		return
 	}
 	domainStatus := strings.ReplaceAll(domain.DomainStatus, "urn:ngsi-ld:DomainStatus:", "")
@@ -38,10 +63,10 @@ func (h *HealthController) Status(c *gin.Context) {
 	// if domain.DomainStatus == config.FUNCTIONAL_DOMAIN_STATUS {
 	// }
 
-	domains, domainsCount, err := h.orionSvc.GetDomainEntities("simplified", true, "domainStatus", "", "", "")
+	domains, domainsCount, err := h.orionSvc.GetDomainEntities("simplified", true, "domainStatus,publicUrl,federatorUrl", "", "", "")
 	if err != nil {
 		log.Println("Error when retrieving domains")
-		returnUnhealthyStatus(c, config.HEALTHY_STATUS, domainStatus, "", "Cannot retrieve continuum domains", err.Error())
+		h.returnUnhealthyStatus(c, config.HEALTHY_STATUS, domainStatus, "", "Cannot retrieve continuum domains", err.Error(), nil)
 		return
 	}
 	var domainsNames string
@@ -53,12 +78,23 @@ func (h *HealthController) Status(c *gin.Context) {
 	}
 
 	// External checks
-	/*** 2. Check if the peer Federator API is reachable and healthy */
-	if !config.IS_ENTRYPOINT {
+	/*** 2. Check the /health of the Federators of all the federated domains (only if requested) */
+	var continuumHealth *models.ContinuumHealth
+	if deep {
+		log.Println("Checking the health of the whole continuum...")
+		continuumHealth = h.checkContinuumHealth(domains, domainsCount)
+	}
+
+	/*** 3. Check if the peer Federator API is reachable and healthy */
+	if !h.cfg().IsEntrypoint {
 		log.Println("Checking the health of the peer federator...")
-		isPeerFederatorHealthy, _, err := h.federatorSvc.CheckFederatorHealth(config.PEER_FEDERATOR_URL)
+		isPeerFederatorHealthy, _, err := h.federatorSvc.CheckFederatorHealth(h.federator.State.Peer().FederatorUrl)
 		if !isPeerFederatorHealthy {
-			returnUnhealthyStatus(c, config.HEALTHY_STATUS, domainStatus, config.UNHEALTHY_STATUS, "The peer federator is unhealty", err.Error())
+			errorMessage := ""
+			if err != nil {
+				errorMessage = err.Error()
+			}
+			h.returnUnhealthyStatus(c, config.HEALTHY_STATUS, domainStatus, config.UNHEALTHY_STATUS, "The peer federator is unhealty", errorMessage, continuumHealth)
 			return
 		}
 	}
@@ -66,31 +102,138 @@ func (h *HealthController) Status(c *gin.Context) {
 	apiHealth := &models.ApiHealth{
 		Status:              config.HEALTHY_STATUS,
 		OrionLdStatus:       config.HEALTHY_STATUS,
-		Domain:              config.DOMAIN_NAME,
+		Domain:              h.cfg().Domain.Name,
 		DomainStatus:        domainStatus,
-		PeerFederatorDomain: config.PeerFederatorDomain,
+		PeerFederatorDomain: h.federator.State.Peer().Domain,
 		PeerFederatorStatus: config.HEALTHY_STATUS,
-		IsEntrypoint:        config.IS_ENTRYPOINT,
+		IsEntrypoint:        h.cfg().IsEntrypoint,
 		FederatedDomains: models.FederatedDomains{
 			Total: domainsCount,
 			Names: domainsNames,
 		},
-		Message: "The aeriOS Federator is HEALTHY",
+		CircuitBreakers:      h.federatorSvc.GetCircuitBreakersState(),
+		PendingNotifications: len(h.federator.RetryOutbox.Pending()),
+		Continuum:            continuumHealth,
+		Message:              "The aeriOS Federator is HEALTHY",
 	}
 	c.JSON(http.StatusOK, apiHealth)
 }
 
-func returnUnhealthyStatus(c *gin.Context, orionLdStatus string, domainStatus string, peerFederatorStatus string, message string, errorMessage string) {
+// Liveness probe: only checks that the process is able to serve requests
+func (h *HealthController) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": config.HEALTHY_STATUS})
+}
+
+// Readiness probe: local broker reachable and local domain Functional, served from the cached background checker
+func (h *HealthController) Ready(c *gin.Context) {
+	readiness := h.federator.Readiness.Status()
+	if readiness.Status != config.HEALTHY_STATUS {
+		c.JSON(http.StatusServiceUnavailable, readiness)
+		return
+	}
+	c.JSON(http.StatusOK, readiness)
+}
+
+// Returns the health of the federated domains collected by the background health monitor
+func (h *HealthController) DomainsHealth(c *gin.Context) {
+	c.JSON(http.StatusOK, h.federator.ContinuumMonitor.DomainsHealth())
+}
+
+// Collects concurrently the /health output of the Federator of every federated domain and checks
+// if their view of the continuum (total of federated domains) agrees with the local one
+func (h *HealthController) checkContinuumHealth(domains []models.DomainSimplified, domainsCount int) *models.ContinuumHealth {
+	domainsHealth := make([]models.ContinuumDomainHealth, 0, len(domains))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := range domains {
+		domainName := models.GetNgsiLdEntityIdValue("Domain", domains[i].Id)
+		if domainName == h.cfg().Domain.Name {
+			continue
+		}
+		wg.Add(1)
+		go func(domainName string, federatorUrl string) {
+			defer wg.Done()
+			domainHealth := models.ContinuumDomainHealth{
+				Domain:       domainName,
+				FederatorUrl: federatorUrl,
+			}
+			apiHealth, statusCode, err := h.federatorSvc.GetFederatorHealth(federatorUrl)
+			if err != nil {
+				domainHealth.Message = err.Error()
+			} else if statusCode != http.StatusOK && statusCode != http.StatusInternalServerError {
+				domainHealth.Message = strconv.Itoa(statusCode) + ": cannot retrieve the health of the Federator"
+			} else {
+				domainHealth.Reachable = true
+				domainHealth.Status = apiHealth.Status
+				domainHealth.OrionLdStatus = apiHealth.OrionLdStatus
+				domainHealth.DomainStatus = apiHealth.DomainStatus
+				domainHealth.PeerFederatorDomain = apiHealth.PeerFederatorDomain
+				domainHealth.PeerFederatorStatus = apiHealth.PeerFederatorStatus
+				domainHealth.FederatedDomainsTotal = apiHealth.FederatedDomains.Total
+				domainHealth.Message = apiHealth.Message
+				// Unhealthy Federators don't report their federated domains
+				if statusCode == http.StatusOK {
+					totalsAgree := apiHealth.FederatedDomains.Total == domainsCount
+					domainHealth.TotalsAgree = &totalsAgree
+				}
+			}
+			mutex.Lock()
+			domainsHealth = append(domainsHealth, domainHealth)
+			mutex.Unlock()
+		}(domainName, domains[i].GetFederatorUrl())
+	}
+	wg.Wait()
+
+	sort.Slice(domainsHealth, func(i, j int) bool {
+		return domainsHealth[i].Domain < domainsHealth[j].Domain
+	})
+	continuumHealth := &models.ContinuumHealth{
+		Status:              config.HEALTHY_STATUS,
+		ConsistentView:      true,
+		ExpectedTotal:       domainsCount,
+		HealthyDomains:      make([]string, 0),
+		UnhealthyDomains:    make([]string, 0),
+		UnhealthyOrionLd:    make([]string, 0),
+		UnreachableDomains:  make([]string, 0),
+		InconsistentDomains: make([]string, 0),
+		Domains:             domainsHealth,
+	}
+	for _, domainHealth := range domainsHealth {
+		if !domainHealth.Reachable {
+			continuumHealth.UnreachableDomains = append(continuumHealth.UnreachableDomains, domainHealth.Domain)
+		} else if domainHealth.Status == config.HEALTHY_STATUS {
+			continuumHealth.HealthyDomains = append(continuumHealth.HealthyDomains, domainHealth.Domain)
+		} else {
+			continuumHealth.UnhealthyDomains = append(continuumHealth.UnhealthyDomains, domainHealth.Domain)
+		}
+		if domainHealth.Reachable && domainHealth.OrionLdStatus != config.HEALTHY_STATUS {
+			continuumHealth.UnhealthyOrionLd = append(continuumHealth.UnhealthyOrionLd, domainHealth.Domain)
+		}
+		if domainHealth.TotalsAgree != nil && !*domainHealth.TotalsAgree {
+			continuumHealth.InconsistentDomains = append(continuumHealth.InconsistentDomains, domainHealth.Domain)
+			continuumHealth.ConsistentView = false
+		}
+	}
+	if len(continuumHealth.HealthyDomains) != len(domainsHealth) || !continuumHealth.ConsistentView {
+		continuumHealth.Status = config.UNHEALTHY_STATUS
+	}
+	return continuumHealth
+}
+
+func (h *HealthController) returnUnhealthyStatus(c *gin.Context, orionLdStatus string, domainStatus string, peerFederatorStatus string, message string, errorMessage string, continuumHealth *models.ContinuumHealth) {
 	apiHealth := models.ApiHealth{
 		Status:               config.UNHEALTHY_STATUS,
 		OrionLdStatus:        orionLdStatus,
-		Domain:               config.DOMAIN_NAME,
+		Domain:               h.cfg().Domain.Name,
 		DomainStatus:         domainStatus,
-		PeerFederatorDomain:  config.PeerFederatorDomain,
+		PeerFederatorDomain:  h.federator.State.Peer().Domain,
 		PeerFederatorStatus:  peerFederatorStatus,
-		IsEntrypoint:         config.IS_ENTRYPOINT,
+		IsEntrypoint:         h.cfg().IsEntrypoint,
 		Message:              message,
 		DetailedErrorMessage: errorMessage,
+		CircuitBreakers:      h.federatorSvc.GetCircuitBreakersState(),
+		PendingNotifications: len(h.federator.RetryOutbox.Pending()),
+		Continuum:            continuumHealth,
 	}
 	c.JSON(http.StatusInternalServerError, apiHealth)
 }
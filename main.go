@@ -1,12 +1,20 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/router"
+	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/state"
 	"github.com/eclipse-aerios/federator/utils"
 )
 
@@ -15,22 +23,108 @@ func main() {
 	log.Println("aeriOS Federator")
 	log.Println("Developed in Go, REST API using GinGonic framework")
 
-	// Load environment variables
-	config.LoadEnvVars()
-	if !config.TLS_CERTIFICATE_VALIDATION {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	// Load the configuration (config file, env vars and flags)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Println("Invalid configuration of the aeriOS Federator:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			log.Println(" - " + line)
+		}
+		os.Exit(1)
+	}
+	store := config.NewStore(cfg, os.Args[1:])
+	runtimeState := state.NewRuntimeState(cfg)
+	store.OnReload(runtimeState.OnConfigReload)
+	tlsTransport, err := services.NewTlsTransport(cfg, runtimeState)
+	if err != nil {
+		log.Println("Invalid TLS configuration of the aeriOS Federator: " + err.Error())
+		os.Exit(1)
 	}
 
-	initialization := &utils.Initialization{}
-	err := initialization.InitializeFederator()
+	// The token cache is shared by the calls to the broker and to the other Federators
+	orionLdAuthSvc := services.NewOrionLdAuthSvc(store, runtimeState, tlsTransport)
+	// The circuit breakers are shared by the calls to the broker and to the other Federators
+	circuitBreakers := services.NewCircuitBreakerTransport(store, tlsTransport)
+	orionldSvc := services.NewOrionldSvc(store, runtimeState, orionLdAuthSvc, circuitBreakers)
+	federatorSvc := services.NewFederatorSvc(store, runtimeState, orionLdAuthSvc, circuitBreakers)
+	federator := utils.NewFederator(store, runtimeState, orionldSvc, federatorSvc)
+	store.WatchFile(federator.Tasks.Every)
 
-	if err != nil {
-		log.Println(err)
-		log.Fatalln("Couldn't initialize the aeriOS Federator in this domain")
+	// The initialization runs in background, so its progress can be observed through /readyz
+	go func() {
+		if err := federator.Initialization.InitializeFederator(); err != nil {
+			log.Println("The initialization of the aeriOS Federator has failed and it needs a restart: " + err.Error())
+			federator.Readiness.Check()
+			return
+		}
+		log.Println("aeriOS Federator successfully initialized")
+		log.Println("=============================================================")
+		federator.Readiness.Check()
+		federator.StartBackgroundTasks()
+	}()
+	federator.Readiness.Start(federator.Tasks)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			store.Reload("SIGHUP")
+		}
+	}()
+
+	server := &http.Server{
+		Addr:    ":" + cfg.AppPort,
+		Handler: router.NewRouter(store, orionldSvc, federatorSvc, federator),
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalln(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), store.Get().ShutdownTimeout)
+	defer cancel()
+	gracefulShutdown(shutdownCtx, server, store.Get(), federator)
+}
+
+// Stops accepting requests and waits for the in-flight ones (e.g. spreads), stops the background tasks,
+// then leaves the continuum if this is an ephemeral domain and finally tries to deliver the notifications
+// pending in the outbox
+func gracefulShutdown(ctx context.Context, server *http.Server, cfg *config.Config, federator *utils.Federator) {
+	log.Println("Shutting down the aeriOS Federator...")
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("The in-flight requests couldn't be completed: " + err.Error())
+	}
+	// Otherwise, the leases and the CSRs removed by the leave could be renewed or recreated meanwhile
+	if !federator.Tasks.Stop(ctx) {
+		log.Println("Timeout stopping the background tasks")
 	}
-	log.Println("aeriOS Federator successfully initialized")
-	log.Println("=============================================================")
 
-	app := router.NewRouter()
-	app.Run(":" + config.APP_PORT)
+	if cfg.EphemeralDomain && federator.Initialization.IsCompleted() {
+		log.Println("Ephemeral domain, so leaving the continuum...")
+		response, err := federator.LeaveContinuum()
+		if err != nil {
+			log.Println("Cannot leave the continuum: " + err.Error())
+		} else {
+			log.Println(response.Message)
+		}
+	}
+
+	done := make(chan int, 1)
+	go func() {
+		done <- federator.RetryOutbox.Flush(true)
+	}()
+	select {
+	case pending := <-done:
+		if pending > 0 {
+			log.Println(strconv.Itoa(pending) + " notifications of the retry outbox couldn't be delivered")
+		}
+	case <-ctx.Done():
+		log.Println("Timeout flushing the retry outbox")
+	}
+	log.Println("aeriOS Federator stopped")
 }
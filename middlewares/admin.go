@@ -0,0 +1,29 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Requires the admin token as bearer token. The admin API is disabled if no admin token is configured,
+// since it changes the configuration and the membership of the domains
+func AdminAuth(store *config.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminToken := store.Get().AdminToken
+		if adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "The admin API is disabled, no ADMIN_TOKEN is configured"})
+			return
+		}
+		token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,24 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/eclipse-aerios/federator/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// Rejects the requests to the federation API until the initialization of the Federator has finished,
+// so other Federators retry them later instead of acting on a partially initialized domain
+func InitializationGuard(initialization *utils.Initialization) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !initialization.IsCompleted() {
+			progress := initialization.Progress()
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"message":        "The aeriOS Federator is still initializing",
+				"initialization": progress,
+			})
+			return
+		}
+		c.Next()
+	}
+}
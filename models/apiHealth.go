@@ -1,19 +1,97 @@
 package models
 
+import "time"
+
 type ApiHealth struct {
-	Status               string           `json:"status,omitempty"`
-	OrionLdStatus        string           `json:"orionLdStatus,omitempty"`
-	Domain               string           `json:"domain,omitempty"`
-	DomainStatus         string           `json:"domainStatus"`
-	PeerFederatorDomain  string           `json:"peerFederatorDomain"`
-	PeerFederatorStatus  string           `json:"peerFederatorStatus"`
-	IsEntrypoint         bool             `json:"isEntrypoint,omitempty"`
-	Message              string           `json:"message"`
-	DetailedErrorMessage string           `json:"detailedErrorMessage,omitempty"`
-	FederatedDomains     FederatedDomains `json:"federatedDomains,omitempty"`
+	Status               string                `json:"status,omitempty"`
+	OrionLdStatus        string                `json:"orionLdStatus,omitempty"`
+	Domain               string                `json:"domain,omitempty"`
+	DomainStatus         string                `json:"domainStatus"`
+	PeerFederatorDomain  string                `json:"peerFederatorDomain"`
+	PeerFederatorStatus  string                `json:"peerFederatorStatus"`
+	IsEntrypoint         bool                  `json:"isEntrypoint,omitempty"`
+	Message              string                `json:"message"`
+	DetailedErrorMessage string                `json:"detailedErrorMessage,omitempty"`
+	FederatedDomains     FederatedDomains      `json:"federatedDomains,omitempty"`
+	CircuitBreakers      []CircuitBreakerState `json:"circuitBreakers,omitempty"`
+	PendingNotifications int                   `json:"pendingNotifications,omitempty"`
+	Continuum            *ContinuumHealth      `json:"continuum,omitempty"`
 }
 
 type FederatedDomains struct {
 	Total int    `json:"total,omitempty"`
 	Names string `json:"names,omitempty"`
 }
+
+// Health of the Federator of a federated domain, as seen by the background health monitor
+type DomainHealth struct {
+	Domain              string     `json:"domain"`
+	FederatorUrl        string     `json:"federatorUrl"`
+	Reachable           bool       `json:"reachable"`
+	Status              string     `json:"status"`
+	DomainStatus        string     `json:"domainStatus,omitempty"`
+	LatencyMs           int64      `json:"latencyMs"`
+	LastSeen            *time.Time `json:"lastSeen,omitempty"`
+	LastChecked         time.Time  `json:"lastChecked"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	CircuitBreaker      string     `json:"circuitBreaker,omitempty"`
+	Message             string     `json:"message,omitempty"`
+}
+
+type CircuitBreakerState struct {
+	Destination         string     `json:"destination"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	LastFailure         string     `json:"lastFailure,omitempty"`
+}
+
+// Continuum-wide health report, built from the /health output of the Federator of every federated domain
+type ContinuumHealth struct {
+	Status              string                  `json:"status"`
+	ConsistentView      bool                    `json:"consistentView"`
+	ExpectedTotal       int                     `json:"expectedTotal"`
+	HealthyDomains      []string                `json:"healthyDomains"`
+	UnhealthyDomains    []string                `json:"unhealthyDomains"`
+	UnhealthyOrionLd    []string                `json:"unhealthyOrionLd"`
+	UnreachableDomains  []string                `json:"unreachableDomains"`
+	InconsistentDomains []string                `json:"inconsistentDomains"`
+	Domains             []ContinuumDomainHealth `json:"domains"`
+}
+
+type ContinuumDomainHealth struct {
+	Domain                string `json:"domain"`
+	FederatorUrl          string `json:"federatorUrl"`
+	Reachable             bool   `json:"reachable"`
+	Status                string `json:"status,omitempty"`
+	OrionLdStatus         string `json:"orionLdStatus,omitempty"`
+	DomainStatus          string `json:"domainStatus,omitempty"`
+	PeerFederatorDomain   string `json:"peerFederatorDomain,omitempty"`
+	PeerFederatorStatus   string `json:"peerFederatorStatus,omitempty"`
+	FederatedDomainsTotal int    `json:"federatedDomainsTotal,omitempty"`
+	TotalsAgree           *bool  `json:"totalsAgree,omitempty"`
+	Message               string `json:"message,omitempty"`
+}
+
+// Readiness of the Federator, served from the cache of the background readiness checker
+type ReadinessStatus struct {
+	Status         string                  `json:"status"`
+	OrionLdStatus  string                  `json:"orionLdStatus"`
+	DomainStatus   string                  `json:"domainStatus"`
+	LastChecked    *time.Time              `json:"lastChecked,omitempty"`
+	Message        string                  `json:"message,omitempty"`
+	Initialization *InitializationProgress `json:"initialization,omitempty"`
+}
+
+// Progress of the initialization of the Federator, whose steps are retried with backoff until they succeed
+// or fail with a non-transient error
+type InitializationProgress struct {
+	Completed      bool       `json:"completed"`
+	CurrentStep    string     `json:"currentStep,omitempty"`
+	FailedStep     string     `json:"failedStep,omitempty"`
+	CompletedSteps []string   `json:"completedSteps"`
+	Attempts       int        `json:"attempts,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	StartedAt      time.Time  `json:"startedAt"`
+	CompletedAt    *time.Time `json:"completedAt,omitempty"`
+}
@@ -9,13 +9,24 @@ type AeriosShimToken struct {
 type KeycloakAccessToken struct {
 	AccessToken      string `json:"access_token"`
 	ExpiresIn        int    `json:"expires_in,omitempty"`
-	ExpiresAt        time.Time
 	RefreshExpiresIn int    `json:"refresh_expires_in,omitempty"`
 	TokenType        string `json:"token_type,omitempty"`
 	NotBeforePolicy  int    `json:"not-before-policy,omitempty"`
 	Scope            string `json:"scope,omitempty"`
 }
 
-func (token KeycloakAccessToken) IsTokenExpired() bool {
-	return time.Now().After(token.ExpiresAt)
+// Token cached by the Federator, whatever its source is
+type AccessToken struct {
+	Value     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	RefreshAt time.Time
+}
+
+func (token AccessToken) IsExpired() bool {
+	return token.Value == "" || !time.Now().Before(token.ExpiresAt)
+}
+
+func (token AccessToken) NeedsRefresh() bool {
+	return token.Value == "" || !time.Now().Before(token.RefreshAt)
 }
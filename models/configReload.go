@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+const (
+	CONFIG_RELOAD_APPLIED   string = "applied"
+	CONFIG_RELOAD_UNCHANGED string = "unchanged"
+	CONFIG_RELOAD_REJECTED  string = "rejected"
+	CONFIG_RELOAD_FAILED    string = "failed"
+)
+
+// Outcome of a hot reload of the configuration. Only the names of the fields are included, never their values
+type ConfigReloadOutcome struct {
+	Trigger        string                `json:"trigger"`
+	Time           time.Time             `json:"time"`
+	Result         string                `json:"result"`
+	ChangedFields  []string              `json:"changedFields,omitempty"`
+	RejectedFields []RejectedConfigField `json:"rejectedFields,omitempty"`
+	Errors         []string              `json:"errors,omitempty"`
+}
+
+type RejectedConfigField struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type ConfigReloadStatus struct {
+	ConfigFile  string                `json:"configFile,omitempty"`
+	LastOutcome *ConfigReloadOutcome  `json:"lastOutcome,omitempty"`
+	History     []ConfigReloadOutcome `json:"history"`
+}
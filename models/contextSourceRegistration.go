@@ -1,27 +1,43 @@
 package models
 
-import "strings"
+import "slices"
 
 type ContextSourceRegistration struct {
-	Id                     string        `json:"id"`
-	Type                   string        `json:"type"`
-	Information            []information `json:"information"`
-	ContextSourceInfo      []KeyValue    `json:"contextSourceInfo"`
-	Mode                   string        `json:"mode"`
-	HostAlias              string        `json:"hostAlias"`
-	Operations             []string      `json:"operations"`
-	Endpoint               string        `json:"endpoint"`
-	Management             CSRManagement `json:"management"`
-	AeriosDomain           string        `json:"aeriosDomain"`
-	AeriosDomainFederation bool          `json:"aeriosDomainFederation"`
+	Id                     string                 `json:"id"`
+	Type                   string                 `json:"type"`
+	Information            OneOrMany[information] `json:"information"`
+	ContextSourceInfo      OneOrMany[KeyValue]    `json:"contextSourceInfo"`
+	Mode                   string                 `json:"mode"`
+	HostAlias              string                 `json:"hostAlias"`
+	Operations             OneOrMany[string]      `json:"operations"`
+	Endpoint               string                 `json:"endpoint"`
+	Tenant                 string                 `json:"tenant,omitempty"`
+	Location               *Geometry              `json:"location,omitempty"`
+	ExpiresAt              string                 `json:"expiresAt,omitempty"`
+	Management             CSRManagement          `json:"management"`
+	AeriosDomain           string                 `json:"aeriosDomain"`
+	AeriosDomainFederation bool                   `json:"aeriosDomainFederation"`
+	AeriosShadow           bool                   `json:"aeriosShadow,omitempty"`
 }
 
+const (
+	INCLUSIVE_CSR_MODE string = "inclusive"
+	EXCLUSIVE_CSR_MODE string = "exclusive"
+	AUXILIARY_CSR_MODE string = "auxiliary"
+)
+
+// Operations that auxiliary CSRs can register, since auxiliary context sources are only used for retrieval
+var RETRIEVAL_OPERATIONS = []string{"retrieveOps", "retrieveEntity", "queryEntity", "queryBatch", "retrieveEntityTypes", "retrieveAttrTypes"}
+
 type CSRManagement struct {
 	LocalOnly bool `json:"localOnly"`
 }
 
+// Registered entities, limited to the given attributes if any of the lists is not empty
 type information struct {
-	Entities []informationEntities `json:"entities"`
+	Entities          OneOrMany[informationEntities] `json:"entities"`
+	PropertyNames     OneOrMany[string]              `json:"propertyNames,omitempty"`
+	RelationshipNames OneOrMany[string]              `json:"relationshipNames,omitempty"`
 }
 
 type informationEntities struct {
@@ -30,161 +46,39 @@ type informationEntities struct {
 }
 
 type KeyValue struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
-func NewInfrastructureCSR(newDomain *NewDomain) ContextSourceRegistration {
-	return ContextSourceRegistration{
-		Id:   "urn:aerios:federation:" + strings.ToLower(newDomain.Name) + ":infrastructure",
-		Type: "ContextSourceRegistration",
-		Mode: "inclusive",
-		Information: []information{
-			{
-				Entities: []informationEntities{
-					{
-						Type: "Domain",
-					},
-					{
-						Type: "LowLevelOrchestrator",
-					},
-					{
-						Type: "InfrastructureElement",
-					},
-				},
-			},
-		},
-		ContextSourceInfo: []KeyValue{
-			{
-				Key:   "Authorization",
-				Value: NGSILD_PREFIX + "request",
-			},
-		},
-		Operations: []string{
-			"retrieveOps",
-		},
-		HostAlias: newDomain.BrokerId,
-		Endpoint:  newDomain.PublicUrl + "/orionld", // Add /orionld to be aligned with current KrakenD config
-		// Endpoint: newDomain.PublicUrl,
-		Management: CSRManagement{
-			LocalOnly: true,
-		},
-		AeriosDomain:           newDomain.Name,
-		AeriosDomainFederation: true,
-	}
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value" yaml:"value"`
 }
 
-func NewServicesCSR(newDomain *NewDomain) ContextSourceRegistration {
-	return ContextSourceRegistration{
-		Id:   "urn:aerios:federation:" + strings.ToLower(newDomain.Name) + ":services",
-		Type: "ContextSourceRegistration",
-		Mode: "inclusive",
-		Information: []information{
-			{
-				Entities: []informationEntities{
-					{
-						Type: "Service",
-					},
-					{
-						Type: "ServiceComponent",
-					},
-					{
-						Type: "NetworkPort",
-					},
-					{
-						Type: "InfrastructureElementRequirements",
-					},
-				},
-			},
-		},
-		ContextSourceInfo: []KeyValue{
-			{
-				Key:   "Authorization",
-				Value: NGSILD_PREFIX + "request",
-			},
-		},
-		Operations: []string{
-			"retrieveOps",
-			"updateOps",
-			"deleteEntity",
-			"deleteAttrs",
-			// "mergeEntity",
-		},
-		HostAlias: newDomain.BrokerId,
-		Endpoint:  newDomain.PublicUrl + "/orionld", // Add /orionld to be aligned with current KrakenD config
-		// Endpoint: newDomain.PublicUrl,
-		Management: CSRManagement{
-			LocalOnly: true,
-		},
-		AeriosDomain:           newDomain.Name,
-		AeriosDomainFederation: true,
+// Returns the parts of the information of the CSR registering the given entity types
+func (r ContextSourceRegistration) informationOf(entityTypes []string) (restricted []information) {
+	for _, info := range r.Information {
+		entities := slices.DeleteFunc(slices.Clone(info.Entities), func(entity informationEntities) bool {
+			return !slices.Contains(entityTypes, entity.Type)
+		})
+		if len(entities) > 0 {
+			info.Entities = entities
+			restricted = append(restricted, info)
+		}
 	}
+	return
 }
 
-func NewOrganizationCSR(newDomain *NewDomain) ContextSourceRegistration {
-	return ContextSourceRegistration{
-		Id:   "urn:aerios:federation:" + strings.ToLower(newDomain.Name) + ":organizations",
-		Type: "ContextSourceRegistration",
-		Mode: "inclusive",
-		Information: []information{
-			{
-				Entities: []informationEntities{
-					{
-						Type: "Organization",
-					},
-				},
-			},
-		},
-		ContextSourceInfo: []KeyValue{
-			{
-				Key:   "Authorization",
-				Value: NGSILD_PREFIX + "request",
-			},
-		},
-		Operations: []string{
-			"retrieveOps",
-		},
-		HostAlias: newDomain.BrokerId,
-		Endpoint:  newDomain.PublicUrl + "/orionld", // Add /orionld to be aligned with current KrakenD config
-		// Endpoint: newDomain.PublicUrl,
-		Management: CSRManagement{
-			LocalOnly: true,
-		},
-		AeriosDomain:           newDomain.Name,
-		AeriosDomainFederation: true,
+// Returns the entity types registered by the CSR
+func (r ContextSourceRegistration) EntityTypes() (entityTypes []string) {
+	for _, info := range r.Information {
+		for _, entity := range info.Entities {
+			entityTypes = append(entityTypes, entity.Type)
+		}
 	}
+	return
 }
 
-func NewBenchmarkCSR(newDomain *NewDomain) ContextSourceRegistration {
-	return ContextSourceRegistration{
-		Id:   "urn:aerios:federation:" + strings.ToLower(newDomain.Name) + ":benchmark",
-		Type: "ContextSourceRegistration",
-		Mode: "inclusive",
-		Information: []information{
-			{
-				Entities: []informationEntities{
-					{
-						Type: "Benchmark",
-					},
-				},
-			},
-		},
-		ContextSourceInfo: []KeyValue{
-			{
-				Key:   "Authorization",
-				Value: NGSILD_PREFIX + "request",
-			},
-		},
-		Operations: []string{
-			"retrieveOps",
-		},
-		HostAlias: newDomain.BrokerId,
-		Endpoint:  newDomain.PublicUrl + "/orionld", // Add /orionld to be aligned with current KrakenD config
-		// Endpoint: newDomain.PublicUrl,
-		Management: CSRManagement{
-			LocalOnly: true,
-		},
-		AeriosDomain:           newDomain.Name,
-		AeriosDomainFederation: true,
-	}
+// Returns the auxiliary version of the CSR used while its domain is in shadow mode, limited to its retrieval
+// operations (false if it has none)
+func (r ContextSourceRegistration) Auxiliary() (ContextSourceRegistration, bool) {
+	r.Mode = AUXILIARY_CSR_MODE
+	r.AeriosShadow = true
+	r.Operations = intersect(r.Operations, RETRIEVAL_OPERATIONS)
+	return r, len(r.Operations) > 0
 }
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CSR_ID_PREFIX = "urn:aerios:federation:"
+
+// Separator of the revision of a CSR id, so an outdated CSR can be replaced by a new one before deleting it
+const CSR_REVISION_SEPARATOR = "~"
+
+// Returns the id of a CSR without its revision, i.e. the id rendered by its template
+func RegistrationBaseId(id string) string {
+	baseId, _, _ := strings.Cut(id, CSR_REVISION_SEPARATOR)
+	return baseId
+}
+
+// Returns a new revision of a CSR id, different from the previous ones
+func NewRegistrationRevision(id string) string {
+	return RegistrationBaseId(id) + CSR_REVISION_SEPARATOR + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Entity types the federation itself relies on (e.g. lease and health checks), so they are always registered
+var FEDERATION_ENTITY_TYPES = []string{"Domain", "Organization"}
+
+// Declarative description of one of the CSRs created for each domain of the continuum, pointing to its broker
+type CSRTemplate struct {
+	IdSuffix    string   `json:"idSuffix" yaml:"idSuffix"`
+	EntityTypes []string `json:"entityTypes" yaml:"entityTypes"`
+	Operations  []string `json:"operations" yaml:"operations"`
+	Mode        string   `json:"mode" yaml:"mode"`
+	// Modes of specific entity types, overriding the mode of the template
+	EntityTypeModes map[string]string `json:"entityTypeModes,omitempty" yaml:"entityTypeModes"`
+	// Attributes registered for specific entity types (all of them if not set), unless the domain limits them
+	EntityTypeAttributes map[string]EntityTypeAttributes `json:"entityTypeAttributes,omitempty" yaml:"entityTypeAttributes"`
+	EndpointPath         string                          `json:"endpointPath" yaml:"endpointPath"`
+	ContextSourceInfo    []KeyValue                      `json:"contextSourceInfo" yaml:"contextSourceInfo"`
+}
+
+type EntityTypeAttributes struct {
+	PropertyNames     []string `json:"propertyNames,omitempty" yaml:"propertyNames"`
+	RelationshipNames []string `json:"relationshipNames,omitempty" yaml:"relationshipNames"`
+}
+
+// Returns true if the registration of the entity type is limited to some attributes by the template
+func (t CSRTemplate) HasAttributes(entityType string) bool {
+	attributes := t.EntityTypeAttributes[entityType]
+	return len(attributes.PropertyNames) > 0 || len(attributes.RelationshipNames) > 0
+}
+
+// Templates of the aeriOS CSRs: infrastructure, organizations, services and benchmark. The /orionld endpoint
+// path is aligned with the current KrakenD config, and only used for the domains that don't advertise a brokerUrl.
+func DefaultCSRTemplates() []CSRTemplate {
+	contextSourceInfo := []KeyValue{
+		{
+			Key:   "Authorization",
+			Value: NGSILD_PREFIX + "request",
+		},
+	}
+	return []CSRTemplate{
+		{
+			IdSuffix:          "infrastructure",
+			EntityTypes:       []string{"Domain", "LowLevelOrchestrator", "InfrastructureElement"},
+			Operations:        []string{"retrieveOps"},
+			Mode:              "inclusive",
+			EndpointPath:      "/orionld",
+			ContextSourceInfo: contextSourceInfo,
+		},
+		{
+			IdSuffix:          "organizations",
+			EntityTypes:       []string{"Organization"},
+			Operations:        []string{"retrieveOps"},
+			Mode:              "inclusive",
+			EndpointPath:      "/orionld",
+			ContextSourceInfo: contextSourceInfo,
+		},
+		{
+			IdSuffix:          "services",
+			EntityTypes:       []string{"Service", "ServiceComponent", "NetworkPort", "InfrastructureElementRequirements"},
+			Operations:        []string{"retrieveOps", "updateOps", "deleteEntity", "deleteAttrs"},
+			Mode:              "inclusive",
+			EndpointPath:      "/orionld",
+			ContextSourceInfo: contextSourceInfo,
+		},
+		{
+			IdSuffix:          "benchmark",
+			EntityTypes:       []string{"Benchmark"},
+			Operations:        []string{"retrieveOps"},
+			Mode:              "inclusive",
+			EndpointPath:      "/orionld",
+			ContextSourceInfo: contextSourceInfo,
+		},
+	}
+}
+
+// Builds the CSRs of the template pointing to the broker of a domain, only for the entity types and operations
+// the domain shares. Since the operations and the mode of a CSR apply to all its entity types, the types with
+// different operations or modes are registered in separate CSRs (the first one keeps the id of the template).
+func (t CSRTemplate) Render(newDomain *NewDomain) (registrations []ContextSourceRegistration) {
+	groups := groupEntityTypes(t.EntityTypes, func(entityType string) ([]string, string) {
+		if len(newDomain.SharedEntityTypes) == 0 {
+			return t.Operations, t.modeOf(newDomain, entityType)
+		}
+		index := newDomain.sharedEntityTypeIndex(entityType)
+		if index < 0 && !slices.Contains(FEDERATION_ENTITY_TYPES, entityType) {
+			return nil, ""
+		}
+		// Federation entity types not advertised by the domain keep the operations of the template
+		if index >= 0 && len(newDomain.SharedEntityTypes[index].Operations) > 0 {
+			return intersect(t.Operations, newDomain.SharedEntityTypes[index].Operations), t.modeOf(newDomain, entityType)
+		}
+		return t.Operations, t.modeOf(newDomain, entityType)
+	})
+
+	for i, group := range groups {
+		idSuffix := t.IdSuffix
+		if i > 0 {
+			idSuffix += "-" + strings.ToLower(group.entityTypes[0])
+		}
+		registrations = append(registrations, t.render(newDomain, idSuffix, group))
+	}
+	return registrations
+}
+
+// Returns the mode of an entity type: the one requested by the domain, the one of the entity type in the
+// template or the one of the template, in that order
+func (t CSRTemplate) modeOf(newDomain *NewDomain, entityType string) string {
+	if index := newDomain.sharedEntityTypeIndex(entityType); index >= 0 && newDomain.SharedEntityTypes[index].Mode != "" {
+		return newDomain.SharedEntityTypes[index].Mode
+	}
+	if mode, isSet := t.EntityTypeModes[entityType]; isSet {
+		return mode
+	}
+	return t.Mode
+}
+
+// Entity types registered in the same CSR
+type registrationGroup struct {
+	entityTypes []string
+	operations  []string
+	mode        string
+}
+
+// Groups the entity types by their operations and mode (the types without operations are left out). The
+// auxiliary context sources are only used for retrieval, so their other operations are dropped.
+func groupEntityTypes(entityTypes []string, registrationOf func(entityType string) (operations []string, mode string)) (groups []registrationGroup) {
+	for _, entityType := range entityTypes {
+		operations, mode := registrationOf(entityType)
+		if mode == AUXILIARY_CSR_MODE {
+			operations = intersect(operations, RETRIEVAL_OPERATIONS)
+		}
+		if len(operations) == 0 {
+			continue
+		}
+		index := slices.IndexFunc(groups, func(group registrationGroup) bool {
+			return group.mode == mode && slices.Equal(group.operations, operations)
+		})
+		if index < 0 {
+			groups = append(groups, registrationGroup{operations: operations, mode: mode})
+			index = len(groups) - 1
+		}
+		groups[index].entityTypes = append(groups[index].entityTypes, entityType)
+	}
+	return
+}
+
+func (t CSRTemplate) render(newDomain *NewDomain, idSuffix string, group registrationGroup) ContextSourceRegistration {
+	// The entity types limited to the same attributes share the same information
+	var infos []information
+	for _, entityType := range group.entityTypes {
+		// The attributes shared by the domain, or the ones of the template otherwise
+		propertyNames := t.EntityTypeAttributes[entityType].PropertyNames
+		relationshipNames := t.EntityTypeAttributes[entityType].RelationshipNames
+		if index := newDomain.sharedEntityTypeIndex(entityType); index >= 0 && newDomain.SharedEntityTypes[index].HasAttributes() {
+			propertyNames = newDomain.SharedEntityTypes[index].PropertyNames
+			relationshipNames = newDomain.SharedEntityTypes[index].RelationshipNames
+		}
+		index := slices.IndexFunc(infos, func(info information) bool {
+			return slices.Equal(info.PropertyNames, propertyNames) && slices.Equal(info.RelationshipNames, relationshipNames)
+		})
+		if index < 0 {
+			infos = append(infos, information{PropertyNames: propertyNames, RelationshipNames: relationshipNames})
+			index = len(infos) - 1
+		}
+		infos[index].Entities = append(infos[index].Entities, informationEntities{Type: entityType})
+	}
+	return ContextSourceRegistration{
+		Id:                CSR_ID_PREFIX + strings.ToLower(newDomain.Name) + ":" + idSuffix,
+		Type:              "ContextSourceRegistration",
+		Mode:              group.mode,
+		Information:       infos,
+		ContextSourceInfo: append([]KeyValue{}, t.ContextSourceInfo...),
+		Operations:        append([]string{}, group.operations...),
+		HostAlias:         newDomain.BrokerId,
+		Endpoint:          newDomain.GetBrokerUrl(t.EndpointPath),
+		Tenant:            newDomain.Tenant,
+		Location:          newDomain.Location,
+		Management: CSRManagement{
+			LocalOnly: true,
+		},
+		AeriosDomain:           newDomain.Name,
+		AeriosDomainFederation: true,
+	}
+}
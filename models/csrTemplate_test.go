@@ -0,0 +1,136 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Summarizes a CSR as "idSuffix mode operations Type[properties;relationships] ...", to compare it in the tests
+func summarize(registration ContextSourceRegistration) string {
+	parts := []string{
+		strings.TrimPrefix(registration.Id, CSR_ID_PREFIX+strings.ToLower(registration.AeriosDomain)+":"),
+		registration.Mode,
+		strings.Join(registration.Operations, ","),
+	}
+	for _, info := range registration.Information {
+		for _, entity := range info.Entities {
+			part := entity.Type
+			if len(info.PropertyNames) > 0 || len(info.RelationshipNames) > 0 {
+				part += "[" + strings.Join(info.PropertyNames, ",") + ";" + strings.Join(info.RelationshipNames, ",") + "]"
+			}
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func summarizeAll(registrations []ContextSourceRegistration) (summaries []string) {
+	for _, registration := range registrations {
+		summaries = append(summaries, summarize(registration))
+	}
+	return
+}
+
+func TestCSRTemplateRender(t *testing.T) {
+	template := CSRTemplate{
+		IdSuffix:     "services",
+		EntityTypes:  []string{"Domain", "Service", "ServiceComponent", "NetworkPort"},
+		Operations:   []string{"retrieveOps", "updateOps"},
+		Mode:         INCLUSIVE_CSR_MODE,
+		EndpointPath: "/orionld",
+	}
+	tests := []struct {
+		name     string
+		template func(template *CSRTemplate)
+		shared   []SharedEntityType
+		want     []string
+	}{
+		{
+			name: "all the entity types shared",
+			want: []string{"services inclusive retrieveOps,updateOps Domain Service ServiceComponent NetworkPort"},
+		},
+		{
+			name:   "only the shared entity types and the federation ones",
+			shared: []SharedEntityType{{EntityType: "Service"}},
+			want:   []string{"services inclusive retrieveOps,updateOps Domain Service"},
+		},
+		{
+			name:   "entity types with other operations in a separate CSR",
+			shared: []SharedEntityType{{EntityType: "Service"}, {EntityType: "ServiceComponent", Operations: []string{"retrieveOps", "deleteEntity"}}},
+			want: []string{
+				"services inclusive retrieveOps,updateOps Domain Service",
+				"services-servicecomponent inclusive retrieveOps ServiceComponent",
+			},
+		},
+		{
+			name:   "entity types without common operations left out",
+			shared: []SharedEntityType{{EntityType: "Service", Operations: []string{"deleteEntity"}}},
+			want:   []string{"services inclusive retrieveOps,updateOps Domain"},
+		},
+		{
+			name: "auxiliary entity types of the template only for retrieval",
+			template: func(template *CSRTemplate) {
+				template.EntityTypeModes = map[string]string{"NetworkPort": AUXILIARY_CSR_MODE}
+			},
+			want: []string{
+				"services inclusive retrieveOps,updateOps Domain Service ServiceComponent",
+				"services-networkport auxiliary retrieveOps NetworkPort",
+			},
+		},
+		{
+			name: "exclusive entity type of the template with its attributes",
+			template: func(template *CSRTemplate) {
+				template.EntityTypeModes = map[string]string{"Service": EXCLUSIVE_CSR_MODE}
+				template.EntityTypeAttributes = map[string]EntityTypeAttributes{"Service": {PropertyNames: []string{"status"}}}
+			},
+			want: []string{
+				"services inclusive retrieveOps,updateOps Domain ServiceComponent NetworkPort",
+				"services-service exclusive retrieveOps,updateOps Service[status;]",
+			},
+		},
+		{
+			name: "mode and attributes of the domain over the ones of the template",
+			template: func(template *CSRTemplate) {
+				template.EntityTypeModes = map[string]string{"Service": AUXILIARY_CSR_MODE}
+				template.EntityTypeAttributes = map[string]EntityTypeAttributes{"Service": {PropertyNames: []string{"status"}}}
+			},
+			shared: []SharedEntityType{{EntityType: "Service", Mode: EXCLUSIVE_CSR_MODE, RelationshipNames: []string{"hasComponent"}}},
+			want: []string{
+				"services inclusive retrieveOps,updateOps Domain",
+				"services-service exclusive retrieveOps,updateOps Service[;hasComponent]",
+			},
+		},
+		{
+			name: "attributes of the template unless the domain limits them",
+			template: func(template *CSRTemplate) {
+				template.EntityTypeAttributes = map[string]EntityTypeAttributes{
+					"Service":          {PropertyNames: []string{"name"}},
+					"ServiceComponent": {PropertyNames: []string{"name"}},
+				}
+			},
+			shared: []SharedEntityType{{EntityType: "Service"}, {EntityType: "ServiceComponent"}},
+			want:   []string{"services inclusive retrieveOps,updateOps Domain Service[name;] ServiceComponent[name;]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := template
+			if tt.template != nil {
+				tt.template(&template)
+			}
+			newDomain := &NewDomain{Name: "Domain02", PublicUrl: "http://domain02.example.org", SharedEntityTypes: tt.shared}
+
+			registrations := template.Render(newDomain)
+
+			if got := summarizeAll(registrations); !slices.Equal(got, tt.want) {
+				t.Errorf("got CSRs\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			for _, registration := range registrations {
+				if registration.Endpoint != "http://domain02.example.org/orionld" {
+					t.Errorf("got endpoint %q, want the publicUrl with the endpointPath", registration.Endpoint)
+				}
+			}
+		})
+	}
+}
@@ -1,27 +1,44 @@
 package models
 
+import "slices"
+
 type Domain struct {
-	Id           string               `json:"id"`
-	Type         string               `json:"type"`
-	Description  string               `json:"description,omitempty"`
-	PublicUrl    string               `json:"publicUrl,omitempty"`
-	Owner        MultipleRelationship `json:"owner,omitempty"`
-	IsEntrypoint bool                 `json:"isEntrypoint"` // TODO solve boolean marshalling (if omitempty, when false, it is omited)
-	DomainStatus Relationship         `json:"domainStatus,omitempty"`
-	FederatorUrl string               `json:"federatorUrl,omitempty"`
-	PublicKey    string               `json:"publicKey"`
+	Id            string               `json:"id"`
+	Type          string               `json:"type"`
+	Description   string               `json:"description,omitempty"`
+	PublicUrl     string               `json:"publicUrl,omitempty"`
+	Owner         MultipleRelationship `json:"owner,omitempty"`
+	IsEntrypoint  bool                 `json:"isEntrypoint"` // TODO solve boolean marshalling (if omitempty, when false, it is omited)
+	DomainStatus  Relationship         `json:"domainStatus,omitempty"`
+	FederatorUrl  string               `json:"federatorUrl,omitempty"`
+	BrokerUrl     string               `json:"brokerUrl,omitempty"`
+	Tenant        string               `json:"tenant,omitempty"`
+	PublicKey     string               `json:"publicKey"`
+	BrokerId      string               `json:"brokerId,omitempty"`
+	LastHeartbeat *Property            `json:"lastHeartbeat,omitempty"`
+	// Only present if the domain doesn't share all its entity types
+	SharedEntityTypes *SharedEntityTypesProperty `json:"sharedEntityTypes,omitempty"`
+	Labels            *LabelsProperty            `json:"labels,omitempty"`
+	Location          *GeoProperty               `json:"location,omitempty"`
 }
 
 type DomainSimplified struct {
-	Id           string   `json:"id"`
-	Type         string   `json:"type"`
-	Description  string   `json:"description,omitempty"`
-	PublicUrl    string   `json:"publicUrl,omitempty"`
-	Owner        []string `json:"owner,omitempty"`
-	IsEntrypoint bool     `json:"isEntrypoint,omitempty"`
-	DomainStatus string   `json:"domainStatus,omitempty"`
-	FederatorUrl string   `json:"federatorUrl,omitempty"`
-	PublicKey    string   `json:"publicKey"`
+	Id                string                      `json:"id"`
+	Type              string                      `json:"type"`
+	Description       string                      `json:"description,omitempty"`
+	PublicUrl         string                      `json:"publicUrl,omitempty"`
+	Owner             OneOrMany[string]           `json:"owner,omitempty"`
+	IsEntrypoint      bool                        `json:"isEntrypoint,omitempty"`
+	DomainStatus      string                      `json:"domainStatus,omitempty"`
+	FederatorUrl      string                      `json:"federatorUrl,omitempty"`
+	BrokerUrl         string                      `json:"brokerUrl,omitempty"`
+	Tenant            string                      `json:"tenant,omitempty"`
+	PublicKey         string                      `json:"publicKey"`
+	BrokerId          string                      `json:"brokerId,omitempty"`
+	LastHeartbeat     string                      `json:"lastHeartbeat,omitempty"`
+	SharedEntityTypes OneOrMany[SharedEntityType] `json:"sharedEntityTypes,omitempty"`
+	Labels            OneOrMany[string]           `json:"labels,omitempty"`
+	Location          *Geometry                   `json:"location,omitempty"`
 }
 
 type NewDomain struct {
@@ -29,6 +46,45 @@ type NewDomain struct {
 	PublicUrl    string `json:"publicUrl" binding:"required"`
 	IsEntrypoint bool   `json:"isEntrypoint"` // TODO check binding:"required"
 	BrokerId     string `json:"brokerId" binding:"required"`
+	// URLs of the broker and the Federator of the domain as reached by the others, derived from the publicUrl
+	// if empty (publicUrl + the endpointPath of the CSR templates and publicUrl + /federator)
+	BrokerUrl    string `json:"brokerUrl,omitempty"`
+	FederatorUrl string `json:"federatorUrl,omitempty"`
+	// NGSI-LD tenant of the broker of the domain holding the federated entities (the default one if empty)
+	Tenant string `json:"tenant,omitempty"`
+	// Entity types the domain exposes to the others (all of them if empty)
+	SharedEntityTypes []SharedEntityType `json:"sharedEntityTypes,omitempty"`
+	// Name of the owner organization and labels of the domain, used by the sharing policies of the others
+	Owner  string   `json:"owner,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+	// Area covered by the domain, registered in its CSRs so geo-queries only reach the relevant domains
+	Location *Geometry `json:"location,omitempty"`
+}
+
+// Entity type shared by a domain, along with the operations allowed on it (all the ones of its CSR template if
+// empty), the attributes registered (all of them if both lists are empty) and the mode of its CSR (the one of
+// its CSR template if empty)
+type SharedEntityType struct {
+	EntityType        string            `json:"entityType" yaml:"entityType"`
+	Operations        OneOrMany[string] `json:"operations,omitempty" yaml:"operations"`
+	Mode              string            `json:"mode,omitempty" yaml:"mode"`
+	PropertyNames     OneOrMany[string] `json:"propertyNames,omitempty" yaml:"propertyNames"`
+	RelationshipNames OneOrMany[string] `json:"relationshipNames,omitempty" yaml:"relationshipNames"`
+}
+
+// Returns true if the entity type is only shared for some attributes
+func (s SharedEntityType) HasAttributes() bool {
+	return len(s.PropertyNames) > 0 || len(s.RelationshipNames) > 0
+}
+
+type SharedEntityTypesProperty struct {
+	Type  string             `json:"type"`
+	Value []SharedEntityType `json:"value"`
+}
+
+type LabelsProperty struct {
+	Type  string   `json:"type"`
+	Value []string `json:"value"`
 }
 
 type NewDomainSpreadResponse struct {
@@ -36,10 +92,55 @@ type NewDomainSpreadResponse struct {
 	Domains                []DomainSimplified          `json:"domains,omitempty"`
 	NewDomainRegistrations []ContextSourceRegistration `json:"newDomainRegistrations,omitempty"`
 	FailedDomains          []string                    `json:"failedDomains,omitempty"`
+	QueuedDomains          []string                    `json:"queuedDomains,omitempty"`
 	Message                string                      `json:"message,omitempty"`
 }
 
 type DeleteDomainSpreadResponse struct {
 	FailedDomains []string `json:"failedDomains,omitempty"`
+	QueuedDomains []string `json:"queuedDomains,omitempty"`
 	Message       string   `json:"message,omitempty"`
 }
+
+// Returns the URL of the Federator of the domain, using publicUrl + /federator if federatorUrl is not present
+func (d *DomainSimplified) GetFederatorUrl() string {
+	if d.FederatorUrl == "" {
+		return d.PublicUrl + "/federator"
+	}
+	return d.FederatorUrl
+}
+
+// Returns the endpoint of the CSRs pointing to the broker of the domain, using publicUrl + the path of the CSR
+// template if brokerUrl is not present
+func (d *NewDomain) GetBrokerUrl(endpointPath string) string {
+	if d.BrokerUrl == "" {
+		return d.PublicUrl + endpointPath
+	}
+	return d.BrokerUrl
+}
+
+func (d *NewDomain) sharedEntityTypeIndex(entityType string) int {
+	return slices.IndexFunc(d.SharedEntityTypes, func(shared SharedEntityType) bool {
+		return shared.EntityType == entityType
+	})
+}
+
+// Builds the NewDomain payload of a remote domain from its Domain entity, so its CSRs can be generated again
+func NewDomainFromEntity(domain *DomainSimplified) *NewDomain {
+	newDomain := &NewDomain{
+		Name:              GetNgsiLdEntityIdValue("Domain", domain.Id),
+		PublicUrl:         domain.PublicUrl,
+		IsEntrypoint:      domain.IsEntrypoint,
+		BrokerId:          domain.BrokerId,
+		BrokerUrl:         domain.BrokerUrl,
+		FederatorUrl:      domain.FederatorUrl,
+		Tenant:            domain.Tenant,
+		SharedEntityTypes: domain.SharedEntityTypes,
+		Labels:            domain.Labels,
+		Location:          domain.Location,
+	}
+	if len(domain.Owner) > 0 {
+		newDomain.Owner = GetNgsiLdEntityIdValue("Organization", domain.Owner[0])
+	}
+	return newDomain
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// List that also accepts a single element, since the JSON-LD compaction of the broker responses replaces the
+// arrays of one element with the element itself
+type OneOrMany[T any] []T
+
+func (l *OneOrMany[T]) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*l = nil
+		return nil
+	}
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, (*[]T)(l))
+	}
+	var element T
+	if err := json.Unmarshal(data, &element); err != nil {
+		return err
+	}
+	*l = OneOrMany[T]{element}
+	return nil
+}
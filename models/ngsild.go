@@ -22,6 +22,26 @@ type MultipleRelationship struct {
 	Object []string `json:"object"`
 }
 
+// GeoJSON geometry, e.g. the area covered by a domain
+type Geometry struct {
+	Type        string      `json:"type" yaml:"type"`
+	Coordinates interface{} `json:"coordinates" yaml:"coordinates"`
+}
+
+type GeoProperty struct {
+	Type  string   `json:"type"`
+	Value Geometry `json:"value"`
+}
+
+var GEOMETRY_TYPES []string = []string{"Point", "MultiPoint", "LineString", "MultiLineString", "Polygon", "MultiPolygon"}
+
+func NewProperty(value string) Property {
+	return Property{
+		Type:  "Property",
+		Value: value,
+	}
+}
+
 func NewRelationship(object string) Relationship {
 	return Relationship{
 		Type:   "Relationship",
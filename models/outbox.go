@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+const (
+	NEW_DOMAIN_NOTIFICATION     string = "newDomain"
+	DELETED_DOMAIN_NOTIFICATION string = "deletedDomain"
+)
+
+// Notification to another Federator pending to be delivered by the retry outbox
+type OutboxMessage struct {
+	Id            string     `json:"id"`
+	Operation     string     `json:"operation"`
+	Destination   string     `json:"destination"`
+	FederatorUrl  string     `json:"federatorUrl"`
+	NewDomain     *NewDomain `json:"newDomain,omitempty"`
+	DeletedDomain string     `json:"deletedDomain,omitempty"`
+	Attempts      int        `json:"attempts"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt"`
+	LastError     string     `json:"lastError,omitempty"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// Newly joined domain whose CSRs are kept in auxiliary mode until the federated queries against it succeed
+type ShadowDomain struct {
+	Domain           string     `json:"domain"`
+	Since            time.Time  `json:"since"`
+	SuccessfulChecks int        `json:"successfulChecks"`
+	LastChecked      *time.Time `json:"lastChecked,omitempty"`
+	Message          string     `json:"message,omitempty"`
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	SHARING_ALLOW string = "allow"
+	SHARING_DENY  string = "deny"
+)
+
+var SHARING_EFFECTS []string = []string{SHARING_ALLOW, SHARING_DENY}
+
+// Local policy deciding which entity types and operations of the other domains are accepted, i.e. registered
+// in the local broker. Each (entity type, operation) pair takes the effect of the first matching rule, or the
+// default effect (allow if empty) when no rule matches.
+type SharingPolicy struct {
+	DefaultEffect string        `json:"defaultEffect,omitempty" yaml:"defaultEffect"`
+	Rules         []SharingRule `json:"rules,omitempty" yaml:"rules"`
+}
+
+// Rule of the sharing policy. All its non-empty selectors (domains, organizations and labels) must match the
+// remote domain, and empty entity types or operations match all of them.
+type SharingRule struct {
+	Name          string   `json:"name" yaml:"name"`
+	Domains       []string `json:"domains,omitempty" yaml:"domains"`
+	Organizations []string `json:"organizations,omitempty" yaml:"organizations"`
+	Labels        []string `json:"labels,omitempty" yaml:"labels"`
+	EntityTypes   []string `json:"entityTypes,omitempty" yaml:"entityTypes"`
+	Operations    []string `json:"operations,omitempty" yaml:"operations"`
+	Effect        string   `json:"effect" yaml:"effect"`
+}
+
+// Effective sharing with a remote domain: what it offers (limited to the CSR templates) and what is accepted
+type DomainSharing struct {
+	Domain              string             `json:"domain"`
+	Organization        string             `json:"organization,omitempty"`
+	Labels              []string           `json:"labels,omitempty"`
+	MatchedRules        []string           `json:"matchedRules,omitempty"`
+	OfferedEntityTypes  []SharedEntityType `json:"offeredEntityTypes"`
+	AcceptedEntityTypes []SharedEntityType `json:"acceptedEntityTypes"`
+}
+
+func (r SharingRule) matchesDomain(domain *NewDomain) bool {
+	if len(r.Domains) > 0 && !slices.Contains(r.Domains, domain.Name) {
+		return false
+	}
+	if len(r.Organizations) > 0 && !slices.Contains(r.Organizations, domain.Owner) {
+		return false
+	}
+	if len(r.Labels) > 0 && !slices.ContainsFunc(r.Labels, func(label string) bool { return slices.Contains(domain.Labels, label) }) {
+		return false
+	}
+	return true
+}
+
+// Returns whether an operation on an entity type of a remote domain is accepted. The retrieval of the
+// federation entity types is always accepted, since the federation itself relies on it.
+func (p SharingPolicy) Allows(domain *NewDomain, entityType string, operation string) bool {
+	if operation == "retrieveOps" && slices.Contains(FEDERATION_ENTITY_TYPES, entityType) {
+		return true
+	}
+	for _, rule := range p.Rules {
+		if !rule.matchesDomain(domain) {
+			continue
+		}
+		if len(rule.EntityTypes) > 0 && !slices.Contains(rule.EntityTypes, entityType) {
+			continue
+		}
+		if len(rule.Operations) > 0 && !slices.Contains(rule.Operations, operation) {
+			continue
+		}
+		return rule.Effect == SHARING_ALLOW
+	}
+	return p.DefaultEffect != SHARING_DENY
+}
+
+// Returns the names of the rules whose selectors match a remote domain
+func (p SharingPolicy) MatchingRules(domain *NewDomain) (names []string) {
+	for _, rule := range p.Rules {
+		if rule.matchesDomain(domain) {
+			names = append(names, rule.Name)
+		}
+	}
+	return
+}
+
+// Returns a copy of the remote domain sharing only the entity types and operations of the CSR templates that
+// it offers and the policy accepts (none of them if the list is empty)
+func (p SharingPolicy) Apply(domain *NewDomain, templates []CSRTemplate) *NewDomain {
+	var accepted []SharedEntityType
+	for _, template := range templates {
+		for _, entityType := range template.EntityTypes {
+			offered := template.Operations
+			if len(domain.SharedEntityTypes) > 0 {
+				index := domain.sharedEntityTypeIndex(entityType)
+				if index < 0 && !slices.Contains(FEDERATION_ENTITY_TYPES, entityType) {
+					continue
+				}
+				if index >= 0 && len(domain.SharedEntityTypes[index].Operations) > 0 {
+					offered = intersect(offered, domain.SharedEntityTypes[index].Operations)
+				}
+			}
+			operations := slices.DeleteFunc(slices.Clone(offered), func(operation string) bool {
+				return !p.Allows(domain, entityType, operation)
+			})
+			if len(operations) == 0 {
+				continue
+			}
+			// The same entity type may appear in several templates, so their operations are merged
+			index := slices.IndexFunc(accepted, func(shared SharedEntityType) bool { return shared.EntityType == entityType })
+			if index < 0 {
+				accepted = append(accepted, SharedEntityType{EntityType: entityType})
+				index = len(accepted) - 1
+				if offeredIndex := domain.sharedEntityTypeIndex(entityType); offeredIndex >= 0 {
+					accepted[index].Mode = domain.SharedEntityTypes[offeredIndex].Mode
+					accepted[index].PropertyNames = domain.SharedEntityTypes[offeredIndex].PropertyNames
+					accepted[index].RelationshipNames = domain.SharedEntityTypes[offeredIndex].RelationshipNames
+				}
+			}
+			for _, operation := range operations {
+				if !slices.Contains(accepted[index].Operations, operation) {
+					accepted[index].Operations = append(accepted[index].Operations, operation)
+				}
+			}
+		}
+	}
+	restricted := *domain
+	restricted.SharedEntityTypes = accepted
+	return &restricted
+}
+
+// Returns the effective sharing with a remote domain
+func (p SharingPolicy) Report(domain *NewDomain, templates []CSRTemplate) DomainSharing {
+	return DomainSharing{
+		Domain:              domain.Name,
+		Organization:        domain.Owner,
+		Labels:              domain.Labels,
+		MatchedRules:        p.MatchingRules(domain),
+		OfferedEntityTypes:  SharingPolicy{}.Apply(domain, templates).SharedEntityTypes,
+		AcceptedEntityTypes: p.Apply(domain, templates).SharedEntityTypes,
+	}
+}
+
+// Restricts an already built CSR pointing to a remote domain (e.g. received from the peer federator) to the
+// operations the policy accepts, splitting it if its entity types end up with different operations
+func (p SharingPolicy) FilterRegistration(registration ContextSourceRegistration, domain *NewDomain) (registrations []ContextSourceRegistration) {
+	groups := groupEntityTypes(registration.EntityTypes(), func(entityType string) ([]string, string) {
+		return slices.DeleteFunc(slices.Clone(registration.Operations), func(operation string) bool {
+			return !p.Allows(domain, entityType, operation)
+		}), registration.Mode
+	})
+	for i, group := range groups {
+		filtered := registration
+		if i > 0 {
+			filtered.Id += "-" + strings.ToLower(group.entityTypes[0])
+		}
+		filtered.Information = registration.informationOf(group.entityTypes)
+		filtered.Operations = group.operations
+		registrations = append(registrations, filtered)
+	}
+	return registrations
+}
+
+// Returns the elements of the first list that are also in the second one, keeping their order
+func intersect(list []string, other []string) []string {
+	return slices.DeleteFunc(slices.Clone(list), func(element string) bool {
+		return !slices.Contains(other, element)
+	})
+}
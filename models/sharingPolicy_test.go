@@ -0,0 +1,191 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSharingPolicyAllows(t *testing.T) {
+	domain := &NewDomain{Name: "Domain02", Owner: "Org02", Labels: []string{"edge", "5g"}}
+	tests := []struct {
+		name       string
+		policy     SharingPolicy
+		entityType string
+		operation  string
+		want       bool
+	}{
+		{name: "allowed without rules", entityType: "Service", operation: "updateOps", want: true},
+		{name: "default effect", policy: SharingPolicy{DefaultEffect: SHARING_DENY}, entityType: "Service", operation: "retrieveOps", want: false},
+		{
+			name:       "federation entity types always retrieved",
+			policy:     SharingPolicy{DefaultEffect: SHARING_DENY},
+			entityType: "Domain",
+			operation:  "retrieveOps",
+			want:       true,
+		},
+		{
+			name:       "other operations of the federation entity types",
+			policy:     SharingPolicy{DefaultEffect: SHARING_DENY},
+			entityType: "Domain",
+			operation:  "updateOps",
+			want:       false,
+		},
+		{
+			name: "first matching rule",
+			policy: SharingPolicy{Rules: []SharingRule{
+				{Name: "deny-updates", Operations: []string{"updateOps"}, Effect: SHARING_DENY},
+				{Name: "allow-all", Effect: SHARING_ALLOW},
+			}},
+			entityType: "Service",
+			operation:  "updateOps",
+			want:       false,
+		},
+		{
+			name: "rule of another domain",
+			policy: SharingPolicy{Rules: []SharingRule{
+				{Name: "deny-domain03", Domains: []string{"Domain03"}, Effect: SHARING_DENY},
+			}},
+			entityType: "Service",
+			operation:  "retrieveOps",
+			want:       true,
+		},
+		{
+			name: "rule of the organization",
+			policy: SharingPolicy{DefaultEffect: SHARING_DENY, Rules: []SharingRule{
+				{Name: "allow-org02", Organizations: []string{"Org02"}, EntityTypes: []string{"Service"}, Effect: SHARING_ALLOW},
+			}},
+			entityType: "Service",
+			operation:  "retrieveOps",
+			want:       true,
+		},
+		{
+			name: "rule of any of the labels",
+			policy: SharingPolicy{Rules: []SharingRule{
+				{Name: "deny-5g", Labels: []string{"cloud", "5g"}, Effect: SHARING_DENY},
+			}},
+			entityType: "Service",
+			operation:  "retrieveOps",
+			want:       false,
+		},
+		{
+			name: "all the selectors of the rule",
+			policy: SharingPolicy{Rules: []SharingRule{
+				{Name: "deny-org02-cloud", Organizations: []string{"Org02"}, Labels: []string{"cloud"}, Effect: SHARING_DENY},
+			}},
+			entityType: "Service",
+			operation:  "retrieveOps",
+			want:       true,
+		},
+		{
+			name: "rule of other entity types",
+			policy: SharingPolicy{Rules: []SharingRule{
+				{Name: "deny-benchmarks", EntityTypes: []string{"Benchmark"}, Effect: SHARING_DENY},
+			}},
+			entityType: "Service",
+			operation:  "retrieveOps",
+			want:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Allows(domain, tt.entityType, tt.operation); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharingPolicyApply(t *testing.T) {
+	templates := []CSRTemplate{
+		{IdSuffix: "infrastructure", EntityTypes: []string{"Domain", "InfrastructureElement"}, Operations: []string{"retrieveOps"}, Mode: INCLUSIVE_CSR_MODE},
+		{IdSuffix: "services", EntityTypes: []string{"Service", "InfrastructureElement"}, Operations: []string{"retrieveOps", "updateOps"}, Mode: INCLUSIVE_CSR_MODE},
+	}
+	denyUpdates := SharingPolicy{Rules: []SharingRule{{Name: "deny-updates", Operations: []string{"updateOps"}, Effect: SHARING_DENY}}}
+	tests := []struct {
+		name   string
+		policy SharingPolicy
+		shared []SharedEntityType
+		want   []string
+	}{
+		{
+			name: "all the entity types of the templates",
+			want: []string{"Domain:retrieveOps", "InfrastructureElement:retrieveOps,updateOps", "Service:retrieveOps,updateOps"},
+		},
+		{
+			name:   "operations accepted by the policy",
+			policy: denyUpdates,
+			want:   []string{"Domain:retrieveOps", "InfrastructureElement:retrieveOps", "Service:retrieveOps"},
+		},
+		{
+			name:   "entity types offered by the domain",
+			shared: []SharedEntityType{{EntityType: "Service", Operations: []string{"updateOps", "deleteEntity"}}},
+			want:   []string{"Domain:retrieveOps", "Service:updateOps"},
+		},
+		{
+			name:   "entity types without accepted operations left out",
+			policy: denyUpdates,
+			shared: []SharedEntityType{{EntityType: "Service", Operations: []string{"updateOps"}}},
+			want:   []string{"Domain:retrieveOps"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain := &NewDomain{Name: "Domain02", SharedEntityTypes: tt.shared}
+			var got []string
+			for _, shared := range tt.policy.Apply(domain, templates).SharedEntityTypes {
+				got = append(got, shared.EntityType+":"+strings.Join(shared.Operations, ","))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharingPolicyFilterRegistration(t *testing.T) {
+	domain := &NewDomain{Name: "Domain02", PublicUrl: "http://domain02.example.org"}
+	template := CSRTemplate{
+		IdSuffix:    "services",
+		EntityTypes: []string{"Service", "ServiceComponent"},
+		Operations:  []string{"retrieveOps", "updateOps"},
+		Mode:        INCLUSIVE_CSR_MODE,
+	}
+	registration := template.Render(domain)[0]
+	tests := []struct {
+		name   string
+		policy SharingPolicy
+		want   []string
+	}{
+		{name: "accepted", want: []string{"services inclusive retrieveOps,updateOps Service ServiceComponent"}},
+		{
+			name:   "split by the accepted operations",
+			policy: SharingPolicy{Rules: []SharingRule{{Name: "deny-updates", EntityTypes: []string{"ServiceComponent"}, Operations: []string{"updateOps"}, Effect: SHARING_DENY}}},
+			want: []string{
+				"services inclusive retrieveOps,updateOps Service",
+				"services-servicecomponent inclusive retrieveOps ServiceComponent",
+			},
+		},
+		{name: "rejected", policy: SharingPolicy{DefaultEffect: SHARING_DENY}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarizeAll(tt.policy.FilterRegistration(registration, domain)); !slices.Equal(got, tt.want) {
+				t.Errorf("got CSRs\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRegistrationRevision(t *testing.T) {
+	id := CSR_ID_PREFIX + "domain02:services"
+	revision := NewRegistrationRevision(id)
+	if revision == id || !strings.HasPrefix(revision, id+CSR_REVISION_SEPARATOR) {
+		t.Errorf("got revision %q of %q", revision, id)
+	}
+	for _, other := range []string{id, revision, NewRegistrationRevision(revision)} {
+		if baseId := RegistrationBaseId(other); baseId != id {
+			t.Errorf("got base id %q of %q, want %q", baseId, other, id)
+		}
+	}
+}
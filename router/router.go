@@ -3,33 +3,53 @@ package router
 import (
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/controllers"
+	"github.com/eclipse-aerios/federator/middlewares"
+	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/utils"
 	"github.com/gin-gonic/gin"
 )
 
-func NewRouter() *gin.Engine {
-	if config.APP_ENV == "production" {
+func NewRouter(store *config.Store, orionldSvc services.OrionldSvc, federatorSvc services.FederatorSvc, federator *utils.Federator) *gin.Engine {
+	cfg := store.Get()
+	if cfg.AppEnv == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	router := gin.New()
 	router.Use(gin.Logger())
 	router.Use(gin.Recovery())
 
-	health := &controllers.HealthController{}
+	health := controllers.NewHealthController(store, orionldSvc, federatorSvc, federator)
 	version := new(controllers.VersionController)
 
 	router.GET("/health", health.Status)
+	router.GET("/livez", health.Live)
+	router.GET("/readyz", health.Ready)
 	router.GET("/version", version.Version)
 	// router.Use(middlewares.AuthMiddleware())
 
+	adminGroup := router.Group("admin")
+	adminGroup.Use(middlewares.AdminAuth(store))
+	{
+		admin := controllers.NewAdminController(store, federator)
+		adminGroup.GET("/config/reloads", admin.ConfigReloads)
+		adminGroup.POST("/config/reload", admin.ReloadConfig)
+		adminGroup.GET("/shadow-domains", admin.ShadowDomains)
+		// The promotion creates CSRs, so it waits for the initialization like the federation API
+		adminGroup.POST("/shadow-domains/:domainName/promote", middlewares.InitializationGuard(federator.Initialization), admin.PromoteShadowDomain)
+	}
+
 	v1 := router.Group("v1")
+	v1.Use(middlewares.InitializationGuard(federator.Initialization))
 	{
 		domainsGroup := v1.Group("domains")
 		{
-			dc := new(controllers.DomainController)
+			dc := controllers.NewDomainController(store, orionldSvc, federatorSvc, federator)
 			domainsGroup.GET("/", dc.List)
 			domainsGroup.GET("/local", dc.GetLocalDomain)
+			domainsGroup.GET("/health", health.DomainsHealth)
+			domainsGroup.GET("/sharing", dc.Sharing)
 			domainsGroup.POST("", dc.NewDomain)
-			if config.IS_ENTRYPOINT {
+			if cfg.IsEntrypoint {
 				domainsGroup.DELETE("/:domainName/spread", dc.SpreadDomainDeletion)
 			}
 			domainsGroup.DELETE("/local", dc.DeleteLocalDomain)
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+)
+
+const (
+	CIRCUIT_CLOSED    string = "CLOSED"
+	CIRCUIT_OPEN      string = "OPEN"
+	CIRCUIT_HALF_OPEN string = "HALF_OPEN"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open, the destination is not called")
+
+type healthProbeKey struct{}
+
+// Marks the request as a health probe, which is not blocked by the circuit breaker of its destination and
+// whose failures are not counted (a 503 only means that the destination is not healthy yet). A successful
+// probe closes the breaker, so a destination that is back is called again without waiting for the cooldown.
+func AsHealthProbe(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), healthProbeKey{}, true))
+}
+
+// Returns true if the failure of a call must be counted by the circuit breaker: only the transport
+// errors and the responses of an unavailable destination, not the errors of the request itself
+func isCircuitFailure(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// Circuit breaker of a single destination, the base URL of a registered upstream (e.g. publicUrl/federator)
+// or scheme://host otherwise. After the configured number of consecutive
+// failures it opens and the calls fail fast. Once the cooldown has passed, a single probe call is
+// allowed (half-open): if it succeeds the breaker is closed, otherwise it opens again. The probe has the
+// cooldown as deadline, so a hanging destination cannot keep the breaker half-open.
+type CircuitBreaker struct {
+	destination         string
+	mutex               sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	probeStartedAt      time.Time
+	cooldown            time.Duration
+	lastFailure         string
+}
+
+// Transport that protects the wrapped one with the circuit breaker of the destination of each request.
+// A single transport is shared by the services, so every service sees the same state of a destination.
+type CircuitBreakerTransport struct {
+	store     *config.Store
+	core      http.RoundTripper
+	mutex     sync.Mutex
+	breakers  map[string]*CircuitBreaker
+	upstreams map[string]bool
+}
+
+func NewCircuitBreakerTransport(store *config.Store, core http.RoundTripper) *CircuitBreakerTransport {
+	return &CircuitBreakerTransport{
+		store:     store,
+		core:      core,
+		breakers:  make(map[string]*CircuitBreaker),
+		upstreams: make(map[string]bool),
+	}
+}
+
+func (t *CircuitBreakerTransport) cfg() *config.Config {
+	return t.store.Get()
+}
+
+func (t *CircuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if probe, _ := req.Context().Value(healthProbeKey{}).(bool); probe {
+		res, err := t.core.RoundTrip(req)
+		if err == nil && res.StatusCode >= 200 && res.StatusCode < 300 {
+			t.getCircuitBreaker(req.URL).recordSuccess()
+		}
+		return res, err
+	}
+	breaker := t.getCircuitBreaker(req.URL)
+	allowed, probe := breaker.allow()
+	if !allowed {
+		return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, breaker.destination)
+	}
+	var cancel context.CancelFunc
+	if probe {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), breaker.probeTimeout())
+		req = req.WithContext(ctx)
+	}
+	res, err := t.core.RoundTrip(req)
+	if cancel != nil {
+		if err != nil {
+			cancel()
+		} else {
+			// The deadline also applies to the body of the response, which is read by the caller
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+		}
+	}
+	if err != nil {
+		breaker.recordFailure(err.Error(), t.cfg().CircuitBreaker)
+	} else if isCircuitFailure(res, err) {
+		breaker.recordFailure(res.Status, t.cfg().CircuitBreaker)
+	} else {
+		breaker.recordSuccess()
+	}
+	return res, err
+}
+
+func baseUrlOf(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + strings.TrimRight(u.Path, "/")
+}
+
+// Registers the base URL of an upstream, so that its calls get their own circuit breaker instead of
+// sharing the one of its host (e.g. publicUrl/orionld and publicUrl/federator)
+func (t *CircuitBreakerTransport) RegisterUpstream(baseUrl string) {
+	u, err := url.Parse(baseUrl)
+	if err != nil || u.Host == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.upstreams[baseUrlOf(u)] = true
+}
+
+// Returns the longest registered upstream containing the URL, or scheme://host if there is none.
+// The transport must be locked by the caller.
+func (t *CircuitBreakerTransport) destinationOf(u *url.URL) string {
+	destination := u.Scheme + "://" + u.Host
+	path := baseUrlOf(u)
+	for upstream := range t.upstreams {
+		if len(upstream) > len(destination) && (path == upstream || strings.HasPrefix(path, upstream+"/")) {
+			destination = upstream
+		}
+	}
+	return destination
+}
+
+func (t *CircuitBreakerTransport) getCircuitBreaker(u *url.URL) *CircuitBreaker {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	destination := t.destinationOf(u)
+	breaker, exists := t.breakers[destination]
+	if !exists {
+		breaker = &CircuitBreaker{destination: destination, state: CIRCUIT_CLOSED}
+		t.breakers[destination] = breaker
+	}
+	return breaker
+}
+
+// Returns whether the call is allowed and whether it is the probe of a half-open breaker
+func (b *CircuitBreaker) allow() (allowed bool, probe bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failingFast() {
+		return false, false
+	}
+	if b.state == CIRCUIT_CLOSED {
+		return true, false
+	}
+	// Let a single probe go through, or a new one if the previous one has passed its deadline
+	log.Println("Circuit breaker of " + b.destination + " half-open, probing the destination...")
+	b.state = CIRCUIT_HALF_OPEN
+	b.probeStartedAt = time.Now()
+	return true, true
+}
+
+// Returns true if the calls are rejected: open within the cooldown, or half-open while the probe is
+// within its deadline. The breaker must be locked by the caller.
+func (b *CircuitBreaker) failingFast() bool {
+	switch b.state {
+	case CIRCUIT_OPEN:
+		return time.Since(b.openedAt) < b.cooldown
+	case CIRCUIT_HALF_OPEN:
+		return time.Since(b.probeStartedAt) < b.cooldown
+	default:
+		return false
+	}
+}
+
+func (b *CircuitBreaker) probeTimeout() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.cooldown
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (b *CircuitBreaker) recordSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != CIRCUIT_CLOSED {
+		log.Println("Circuit breaker of " + b.destination + " closed")
+	}
+	b.state = CIRCUIT_CLOSED
+	b.consecutiveFailures = 0
+}
+
+func (b *CircuitBreaker) recordFailure(reason string, settings config.CircuitBreakerConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.consecutiveFailures++
+	b.lastFailure = reason
+	if b.state == CIRCUIT_HALF_OPEN || b.consecutiveFailures >= settings.FailureThreshold {
+		if b.state != CIRCUIT_OPEN {
+			log.Println("Circuit breaker of " + b.destination + " opened: " + reason)
+		}
+		b.state = CIRCUIT_OPEN
+		b.openedAt = time.Now()
+		b.cooldown = settings.Cooldown
+	}
+}
+
+func (b *CircuitBreaker) snapshot() models.CircuitBreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state := models.CircuitBreakerState{
+		Destination:         b.destination,
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		LastFailure:         b.lastFailure,
+	}
+	if b.state != CIRCUIT_CLOSED {
+		openedAt := b.openedAt
+		state.OpenedAt = &openedAt
+	}
+	return state
+}
+
+// Returns true if the calls to the upstream with the base URL are currently failing fast
+func (t *CircuitBreakerTransport) IsCircuitOpen(rawUrl string) bool {
+	t.RegisterUpstream(rawUrl)
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	t.mutex.Lock()
+	breaker, exists := t.breakers[t.destinationOf(u)]
+	t.mutex.Unlock()
+	if !exists {
+		return false
+	}
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.failingFast()
+}
+
+// Returns the state of the circuit breaker of the upstream with the base URL
+func (t *CircuitBreakerTransport) GetCircuitBreakerState(rawUrl string) string {
+	t.RegisterUpstream(rawUrl)
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return t.getCircuitBreaker(u).snapshot().State
+}
+
+// Returns the state of all the circuit breakers, sorted by destination
+func (t *CircuitBreakerTransport) GetCircuitBreakersState() []models.CircuitBreakerState {
+	t.mutex.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(t.breakers))
+	for _, breaker := range t.breakers {
+		breakers = append(breakers, breaker)
+	}
+	t.mutex.Unlock()
+
+	states := make([]models.CircuitBreakerState, 0, len(breakers))
+	for _, breaker := range breakers {
+		states = append(states, breaker.snapshot())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Destination < states[j].Destination
+	})
+	return states
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Call of a circuit breaker test: the answer of the destination (a transport error if the status is 0) and the
+// expected outcome
+type circuitBreakerCall struct {
+	healthProbe bool
+	wait        time.Duration
+	status      int
+	wantCalled  bool
+	wantState   string
+}
+
+const testCooldown = 50 * time.Millisecond
+
+func newTestCircuitBreakerTransport(status *int, called *bool) *CircuitBreakerTransport {
+	cfg := config.Default()
+	cfg.CircuitBreaker.FailureThreshold = 2
+	cfg.CircuitBreaker.Cooldown = testCooldown
+	return NewCircuitBreakerTransport(config.NewStore(cfg, nil), roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		*called = true
+		if *status == 0 {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: *status, Status: http.StatusText(*status), Body: io.NopCloser(strings.NewReader(""))}, nil
+	}))
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		calls []circuitBreakerCall
+	}{
+		{
+			name: "failures below the threshold",
+			calls: []circuitBreakerCall{
+				{status: http.StatusServiceUnavailable, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: http.StatusOK, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: 0, wantCalled: true, wantState: CIRCUIT_CLOSED},
+			},
+		},
+		{
+			name: "errors of the request not counted",
+			calls: []circuitBreakerCall{
+				{status: http.StatusBadRequest, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: http.StatusInternalServerError, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: http.StatusNotFound, wantCalled: true, wantState: CIRCUIT_CLOSED},
+			},
+		},
+		{
+			name: "open after the threshold and failing fast",
+			calls: []circuitBreakerCall{
+				{status: http.StatusBadGateway, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: 0, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{status: http.StatusOK, wantCalled: false, wantState: CIRCUIT_OPEN},
+			},
+		},
+		{
+			name: "closed by a successful probe after the cooldown",
+			calls: []circuitBreakerCall{
+				{status: 0, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: 0, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{wait: testCooldown, status: http.StatusOK, wantCalled: true, wantState: CIRCUIT_CLOSED},
+			},
+		},
+		{
+			name: "open again after a failed probe",
+			calls: []circuitBreakerCall{
+				{status: 0, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: 0, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{wait: testCooldown, status: http.StatusGatewayTimeout, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{status: http.StatusOK, wantCalled: false, wantState: CIRCUIT_OPEN},
+			},
+		},
+		{
+			name: "health probes not blocked and their failures not counted",
+			calls: []circuitBreakerCall{
+				{status: 0, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: 0, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{healthProbe: true, status: http.StatusServiceUnavailable, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{healthProbe: true, status: 0, wantCalled: true, wantState: CIRCUIT_OPEN},
+			},
+		},
+		{
+			name: "closed by a successful health probe within the cooldown",
+			calls: []circuitBreakerCall{
+				{status: 0, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: 0, wantCalled: true, wantState: CIRCUIT_OPEN},
+				{healthProbe: true, status: http.StatusOK, wantCalled: true, wantState: CIRCUIT_CLOSED},
+				{status: http.StatusOK, wantCalled: true, wantState: CIRCUIT_CLOSED},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status int
+			var called bool
+			transport := newTestCircuitBreakerTransport(&status, &called)
+			for i, call := range tt.calls {
+				time.Sleep(call.wait)
+				status, called = call.status, false
+				req, _ := http.NewRequest(http.MethodGet, "http://domain02.example.org/federator/health", nil)
+				if call.healthProbe {
+					req = AsHealthProbe(req)
+				}
+
+				res, err := transport.RoundTrip(req)
+				if err == nil {
+					res.Body.Close()
+				}
+
+				if called != call.wantCalled {
+					t.Errorf("call %d: got destination called %t, want %t", i, called, call.wantCalled)
+				}
+				if !call.wantCalled && !errors.Is(err, ErrCircuitOpen) {
+					t.Errorf("call %d: got error %v, want %v", i, err, ErrCircuitOpen)
+				}
+				if state := transport.GetCircuitBreakerState("http://domain02.example.org"); state != call.wantState {
+					t.Errorf("call %d: got state %s, want %s", i, state, call.wantState)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDestinations(t *testing.T) {
+	var status int
+	var called bool
+	transport := newTestCircuitBreakerTransport(&status, &called)
+	transport.RegisterUpstream("http://domain02.example.org/federator")
+
+	// Open the breaker of the Federator, which must not affect the broker on the same host
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://domain02.example.org/federator/v1/domains", nil)
+		if _, err := transport.RoundTrip(req); err == nil {
+			t.Fatal("expected a transport error")
+		}
+	}
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{url: "http://domain02.example.org/federator", want: true},
+		{url: "http://domain02.example.org/federator/", want: true},
+		{url: "http://domain02.example.org/orionld", want: false},
+		{url: "http://domain02.example.org", want: false},
+		{url: "http://domain03.example.org/federator", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := transport.IsCircuitOpen(tt.url); got != tt.want {
+				t.Errorf("got circuit open %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	states := transport.GetCircuitBreakersState()
+	if len(states) != 1 || states[0].Destination != "http://domain02.example.org/federator" || states[0].LastFailure != "connection refused" {
+		t.Errorf("got circuit breakers %+v, want only the open one of the Federator", states)
+	}
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"time"
+)
+
+const CLIENT_ASSERTION_TYPE = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+const CLIENT_ASSERTION_LIFETIME = time.Minute
+
+// Builds the signed JWT used to authenticate an OAuth client with the private_key_jwt method (RFC 7523),
+// signed with RS256 or ES256 depending on the type of the private key
+func NewClientAssertion(clientId string, audience string, privateKeyFile string, keyId string) (string, error) {
+	key, err := loadPrivateKey(privateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	alg := "RS256"
+	if _, isEcdsa := key.(*ecdsa.PrivateKey); isEcdsa {
+		alg = "ES256"
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if keyId != "" {
+		header["kid"] = keyId
+	}
+	claims := map[string]interface{}{
+		"iss": clientId,
+		"sub": clientId,
+		"aud": audience,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": now.Add(CLIENT_ASSERTION_LIFETIME).Unix(),
+	}
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		if err == nil {
+			// JWS uses the fixed-size concatenation of r and s instead of ASN.1
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Loads an RSA or P-256 EC private key from a PEM file (PKCS#8, PKCS#1 or SEC 1)
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in the private key file " + path)
+	}
+	var key interface{}
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, errors.New("unsupported private key in " + path + " (RSA or EC P-256 expected)")
+			}
+		}
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve.Params().BitSize != 256 {
+			return nil, errors.New("unsupported EC curve in " + path + " (P-256 expected)")
+		}
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key in " + path + " (RSA or EC P-256 expected)")
+}
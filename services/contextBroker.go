@@ -0,0 +1,147 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+)
+
+var ErrNoSourceIdentity = errors.New("the context broker doesn't expose its source identity")
+
+// Parts of the NGSI-LD API that differ between the context brokers: the health check, the identity of the
+// broker and the options of the requests. OrionldSvc builds the requests of the federation and relies on the
+// context broker of the domain (CB_TYPE) for them, so a domain running another NGSI-LD broker can join.
+type ContextBroker interface {
+	// Checks the health of the broker through its API (endpoint health check mode)
+	CheckHealth(client *http.Client, cbUrl string) error
+	// Returns the identity of the broker, or ErrNoSourceIdentity if the broker doesn't expose it
+	GetSourceIdentity(client *http.Client, cbUrl string) (*models.SourceIdentity, error)
+	// Restricts a request to the entities of the broker itself, so it is not forwarded to other domains
+	SetLocal(queryParams url.Values)
+	// Requests the entities in the given representation (normalized or simplified)
+	SetFormat(queryParams url.Values, format string)
+	// Marks a request meant to be forwarded to the brokers of the other domains
+	SetFederated(req *http.Request)
+}
+
+func NewContextBroker(cbType string) ContextBroker {
+	switch cbType {
+	case config.SCORPIO_CB_TYPE, config.STELLIO_CB_TYPE:
+		return &NgsiLdBroker{}
+	default:
+		return &OrionLdBroker{}
+	}
+}
+
+// Orion-LD, which exposes its version and source identity and supports the aeriOS specific header
+type OrionLdBroker struct{}
+
+func (b *OrionLdBroker) CheckHealth(client *http.Client, cbUrl string) error {
+	log.Println("Performing an HTTP GET request to the /version endpoint...")
+	res, err := getHealthProbe(client, cbUrl+VERSION_PATH)
+	if err != nil {
+		log.Println("Error reaching the version endpoint")
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(strconv.Itoa(res.StatusCode) + ": error reaching the version endpoint")
+	}
+	return nil
+}
+
+func (b *OrionLdBroker) GetSourceIdentity(client *http.Client, cbUrl string) (sourceIdentity *models.SourceIdentity, err error) {
+	res, err := client.Get(cbUrl + SOURCE_IDENTITY_PATH)
+	if err != nil {
+		log.Println("Error retrieving Source Identity of the broker")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return sourceIdentity, errors.New(strconv.Itoa(res.StatusCode) + ": error retrieving Source Identity of the broker")
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %v", err)
+		return
+	}
+	err = json.Unmarshal(body, &sourceIdentity)
+	if err != nil {
+		log.Println("Error unmarshalling response body")
+		return
+	}
+	return sourceIdentity, err
+}
+
+func (b *OrionLdBroker) SetLocal(queryParams url.Values) {
+	queryParams.Set("local", "true")
+}
+
+func (b *OrionLdBroker) SetFormat(queryParams url.Values, format string) {
+	queryParams.Set("format", format)
+}
+
+func (b *OrionLdBroker) SetFederated(req *http.Request) {
+	req.Header.Set("aerOS", "true")
+}
+
+// Broker following the NGSI-LD API without the Orion-LD extensions (Scorpio or Stellio): its health is checked
+// by listing the entity types, it has no source identity and the simplified representation is requested
+// through the keyValues option
+type NgsiLdBroker struct{}
+
+func (b *NgsiLdBroker) CheckHealth(client *http.Client, cbUrl string) error {
+	log.Println("Performing an HTTP GET request to the /types endpoint...")
+	res, err := getHealthProbe(client, cbUrl+TYPES_PATH)
+	if err != nil {
+		log.Println("Error reaching the types endpoint")
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(strconv.Itoa(res.StatusCode) + ": error reaching the types endpoint")
+	}
+	return nil
+}
+
+func (b *NgsiLdBroker) GetSourceIdentity(client *http.Client, cbUrl string) (*models.SourceIdentity, error) {
+	return nil, fmt.Errorf("%w: %s", ErrNoSourceIdentity, cbUrl)
+}
+
+func (b *NgsiLdBroker) SetLocal(queryParams url.Values) {
+	queryParams.Set("local", "true")
+}
+
+func (b *NgsiLdBroker) SetFormat(queryParams url.Values, format string) {
+	if format != "simplified" && format != "keyValues" {
+		return
+	}
+	options := queryParams.Get("options")
+	if options == "" {
+		queryParams.Set("options", "keyValues")
+	} else if !strings.Contains(options, "keyValues") {
+		queryParams.Set("options", options+",keyValues")
+	}
+}
+
+func (b *NgsiLdBroker) SetFederated(req *http.Request) {}
+
+// Sends a health probe to the broker, whose failure is not counted by its circuit breaker
+func getHealthProbe(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(AsHealthProbe(req))
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// URL of the destination of a request without query, as matched by the auth profiles and the TLS overrides
+func destinationUrl(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// Whether a destination belongs to any of the domains (if its domain is known) or matches any of the URL patterns
+func matchesDestination(domains []string, urlPatterns []string, domain string, destination string) bool {
+	if domain != "" && slices.Contains(domains, domain) {
+		return true
+	}
+	for _, pattern := range urlPatterns {
+		if matchesUrlPattern(pattern, destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches a URL prefix in which * matches any characters except /, so a host wildcard cannot match a path
+func matchesUrlPattern(pattern string, destination string) bool {
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, "[^/]*")
+	if !strings.HasSuffix(pattern, "/") {
+		// The prefix must end at a boundary, so https://example.org does not match https://example.org.evil.com
+		expr += "(/|$)"
+	}
+	matched, err := regexp.MatchString(expr, destination)
+	return err == nil && matched
+}
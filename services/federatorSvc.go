@@ -11,23 +11,46 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/state"
 )
 
 type FederatorSvc struct {
+	store          *config.Store
+	state          *state.RuntimeState
 	orionLdAuthSvc OrionLdAuthSvc
+	transport      *CircuitBreakerTransport
+}
+
+func NewFederatorSvc(store *config.Store, runtimeState *state.RuntimeState, orionLdAuthSvc OrionLdAuthSvc, circuitBreakers *CircuitBreakerTransport) FederatorSvc {
+	return FederatorSvc{
+		store:          store,
+		state:          runtimeState,
+		orionLdAuthSvc: orionLdAuthSvc,
+		transport:      circuitBreakers,
+	}
+}
+
+func (f *FederatorSvc) cfg() *config.Config {
+	return f.store.Get()
 }
 
 const DOMAINS_PATH = "/v1/domains"
+const LOCAL_DOMAIN_PATH = "/local"
 const HEALTH_PATH = "/health"
 
+// A dead Federator must not block the health checks (e.g. the background health monitor)
+const HEALTH_CHECK_TIMEOUT = 10 * time.Second
+
 // Notifies a new domain creation to another federator, acting as the PEER domain
 // FIXME can this function just return the error? The response was only used for testing purposes...
 func (f *FederatorSvc) NotifyNewDomain(newDomain *models.NewDomain, federatorUrl string) (response *models.NewDomainSpreadResponse, err error) {
 	queryParams := url.Values{}
 	queryParams.Add("spread", "false")
+	f.transport.RegisterUpstream(federatorUrl)
 	fullURL := fmt.Sprintf("%s%s?%s", federatorUrl, DOMAINS_PATH, queryParams.Encode())
 
 	bodyJson, err := json.Marshal(newDomain)
@@ -42,7 +65,7 @@ func (f *FederatorSvc) NotifyNewDomain(newDomain *models.NewDomain, federatorUrl
 	}
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           f.transport,
 			orionLdAuthSvc: f.orionLdAuthSvc,
 		},
 	}
@@ -80,9 +103,10 @@ func (f *FederatorSvc) NotifyNewDomain(newDomain *models.NewDomain, federatorUrl
 func (f *FederatorSvc) SpreadNewLocalDomain() (response *models.NewDomainSpreadResponse, err error) {
 	queryParams := url.Values{}
 	queryParams.Add("spread", "true")
-	fullURL := fmt.Sprintf("%s%s?%s", config.PEER_FEDERATOR_URL, DOMAINS_PATH, queryParams.Encode())
+	f.transport.RegisterUpstream(f.state.Peer().FederatorUrl)
+	fullURL := fmt.Sprintf("%s%s?%s", f.state.Peer().FederatorUrl, DOMAINS_PATH, queryParams.Encode())
 
-	bodyJson, err := json.Marshal(config.LOCAL_DOMAIN)
+	bodyJson, err := json.Marshal(f.state.LocalDomain(f.cfg()))
 	if err != nil {
 		log.Println("Failed to encode the domain in JSON")
 		return
@@ -94,7 +118,7 @@ func (f *FederatorSvc) SpreadNewLocalDomain() (response *models.NewDomainSpreadR
 	}
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           f.transport,
 			orionLdAuthSvc: f.orionLdAuthSvc,
 		},
 	}
@@ -133,6 +157,7 @@ func (f *FederatorSvc) SpreadNewLocalDomain() (response *models.NewDomainSpreadR
 
 // Notifies a domain deletion to another federator, acting as the PEER domain
 func (f *FederatorSvc) NotifyDeletedDomain(domainId string, federatorUrl string) (err error) {
+	f.transport.RegisterUpstream(federatorUrl)
 	fullURL := fmt.Sprintf("%s%s/%s", federatorUrl, DOMAINS_PATH, domainId)
 	req, err := http.NewRequest(http.MethodDelete, fullURL, nil)
 	if err != nil {
@@ -141,7 +166,7 @@ func (f *FederatorSvc) NotifyDeletedDomain(domainId string, federatorUrl string)
 	}
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           f.transport,
 			orionLdAuthSvc: f.orionLdAuthSvc,
 		},
 	}
@@ -158,47 +183,154 @@ func (f *FederatorSvc) NotifyDeletedDomain(domainId string, federatorUrl string)
 	return
 }
 
+// Retrieves the local Domain entity of another federator directly from it (e.g. when its CSRs are suspended)
+func (f *FederatorSvc) GetFederatorLocalDomain(federatorUrl string) (domain *models.DomainSimplified, err error) {
+	f.transport.RegisterUpstream(federatorUrl)
+	fullURL := fmt.Sprintf("%s%s%s", federatorUrl, DOMAINS_PATH, LOCAL_DOMAIN_PATH)
+	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
+	if err != nil {
+		log.Println("HTTP client: could not create request")
+		return
+	}
+	client := &http.Client{
+		Transport: &Interceptor{
+			core:           f.transport,
+			orionLdAuthSvc: f.orionLdAuthSvc,
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Println("Error retrieving the local domain of another Federator")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return domain, errors.New(strconv.Itoa(res.StatusCode) + ": error retrieving the local domain of the Federator")
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %v", err)
+		return
+	}
+	err = json.Unmarshal(body, &domain)
+	if err != nil {
+		log.Println("Error unmarshalling response body")
+		return
+	}
+	return domain, err
+}
+
+// Retrieves the domains of the continuum as seen by another federator (e.g. by the peer federator when the
+// creation of the local domain was spread before a restart)
+func (f *FederatorSvc) GetFederatorDomains(federatorUrl string) (domains []models.DomainSimplified, err error) {
+	f.transport.RegisterUpstream(federatorUrl)
+	fullURL := fmt.Sprintf("%s%s/", federatorUrl, DOMAINS_PATH)
+	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
+	if err != nil {
+		log.Println("HTTP client: could not create request")
+		return
+	}
+	client := &http.Client{
+		Transport: &Interceptor{
+			core:           f.transport,
+			orionLdAuthSvc: f.orionLdAuthSvc,
+		},
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Println("Error retrieving the domains of another Federator")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(strconv.Itoa(res.StatusCode) + ": error retrieving the domains of the Federator")
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %v", err)
+		return
+	}
+	err = json.Unmarshal(body, &domains)
+	if err != nil {
+		log.Println("Error unmarshalling response body")
+		return nil, err
+	}
+	return domains, nil
+}
+
 func (f *FederatorSvc) CheckFederatorHealth(url string) (bool, string, error) {
 	log.Println("Checking the health of another Federator...")
+	apiHealth, statusCode, err := f.GetFederatorHealth(url)
+	if err != nil {
+		return false, "", err
+	}
+	// check status
+	if statusCode == http.StatusOK {
+		return true, apiHealth.Domain, nil
+	} else if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		// The token is not valid, unauthorized request to the peer federator
+		log.Println("The token is not valid, unauthorized request sent to the peer federator (" + strconv.Itoa(statusCode) + ")")
+	}
+	return false, "", nil
+}
+
+// Retrieves the health report of another Federator, which is also returned if the Federator is unhealthy
+func (f *FederatorSvc) GetFederatorHealth(url string) (apiHealth *models.ApiHealth, statusCode int, err error) {
 	// build request
 	fullURL := fmt.Sprintf("%s%s", url, HEALTH_PATH)
 	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
 	if err != nil {
 		log.Println("HTTP client: could not create request")
-		return false, "", err
+		return
 	}
 	// use token interceptor
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           f.transport,
 			orionLdAuthSvc: f.orionLdAuthSvc,
 		},
+		Timeout: HEALTH_CHECK_TIMEOUT,
 	}
-	// send the request
-	res, err := client.Do(req)
+	// send the request, the failed health probes are not counted by the circuit breaker
+	res, err := client.Do(AsHealthProbe(req))
 	if err != nil {
 		log.Println("Error retrieving health info")
-		return false, "", err
+		return
 	}
 	defer res.Body.Close()
-	// check status
-	if res.StatusCode == http.StatusOK {
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			log.Printf("Error reading response body: %v", err)
-			return false, "", err
+	statusCode = res.StatusCode
+
+	apiHealth = &models.ApiHealth{}
+	if statusCode == http.StatusOK || statusCode == http.StatusInternalServerError {
+		body, readErr := io.ReadAll(res.Body)
+		if readErr != nil {
+			log.Printf("Error reading response body: %v", readErr)
+			return apiHealth, statusCode, readErr
 		}
-		apiHealth := &models.ApiHealth{}
-		err = json.Unmarshal(body, apiHealth)
-		if err != nil {
-			return false, "", err
+		// The body of an unhealthy response is optional (e.g. errors of an API gateway)
+		unmarshalErr := json.Unmarshal(body, apiHealth)
+		if statusCode == http.StatusOK {
+			err = unmarshalErr
 		}
-		return true, apiHealth.Domain, err
-	} else if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
-		// The token is not valid, unauthorized request to the peer federator
-		log.Println("The token is not valid, unauthorized request sent to the peer federator (" + strconv.Itoa(res.StatusCode) + ")")
-		return false, "", err
-	} else {
-		return false, "", err
 	}
+	return
+}
+
+// Returns true if the calls to the Federator with the URL are currently failing fast
+func (f *FederatorSvc) IsCircuitOpen(federatorUrl string) bool {
+	return f.transport.IsCircuitOpen(federatorUrl)
+}
+
+// Returns the state of the circuit breaker of the Federator with the URL
+func (f *FederatorSvc) GetCircuitBreakerState(federatorUrl string) string {
+	return f.transport.GetCircuitBreakerState(federatorUrl)
+}
+
+// Returns the state of all the circuit breakers, including the ones of the broker
+func (f *FederatorSvc) GetCircuitBreakersState() []models.CircuitBreakerState {
+	return f.transport.GetCircuitBreakersState()
 }
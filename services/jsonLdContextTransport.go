@@ -0,0 +1,35 @@
+package services
+
+import (
+	"net/http"
+
+	"github.com/eclipse-aerios/federator/config"
+)
+
+const JSONLD_CONTEXT_REL = "http://www.w3.org/ns/json-ld#context"
+
+// Transport that sends the aeriOS @context as a Link header in every request to the broker, so the custom
+// attributes of the Domain entities and the CSRs (and the csf and q filters using them) are expanded with the
+// aeriOS vocabulary instead of the default one. The request bodies are plain JSON, as required with a Link header.
+type JsonLdContextTransport struct {
+	store *config.Store
+	core  http.RoundTripper
+}
+
+func NewJsonLdContextTransport(store *config.Store, core http.RoundTripper) *JsonLdContextTransport {
+	return &JsonLdContextTransport{
+		store: store,
+		core:  core,
+	}
+}
+
+func (t *JsonLdContextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	context := t.store.Get().AeriosContextUrl
+	if context == "" {
+		return t.core.RoundTrip(req)
+	}
+	// The RoundTripper must not modify the original request
+	withContext := req.Clone(req.Context())
+	withContext.Header.Set("Link", "<"+context+">; rel=\""+JSONLD_CONTEXT_REL+"\"; type=\"application/ld+json\"")
+	return t.core.RoundTrip(withContext)
+}
@@ -7,15 +7,22 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/state"
 )
 
 type OrionLdAuthSvc struct {
+	store  *config.Store
+	state  *state.RuntimeState
+	tokens *TokenManager
+	client *http.Client
 }
 
 type Interceptor struct {
@@ -25,13 +32,22 @@ type Interceptor struct {
 
 const KEYCLOAK_REALM_PATH = "/auth/realms/"
 const KEYCLOAK_TOKEN_PATH = "/protocol/openid-connect/token"
-const KEYCLOAK_TOKEN_VALIDATION_PATH = "/protocol/openid-connect/userinfo"
 const SHIM_TOKEN_PATH = "/token/cb"
 
-func (s *OrionLdAuthSvc) GetTokenFromShim() (token string, err error) {
+func NewOrionLdAuthSvc(store *config.Store, runtimeState *state.RuntimeState, tlsTransport http.RoundTripper) OrionLdAuthSvc {
+	s := OrionLdAuthSvc{store: store, state: runtimeState, client: &http.Client{Transport: tlsTransport}}
+	s.tokens = NewTokenManager(store, runtimeState, s.fetchToken)
+	return s
+}
+
+func (s *OrionLdAuthSvc) cfg() *config.Config {
+	return s.store.Get()
+}
+
+func (s *OrionLdAuthSvc) GetTokenFromShim(settings config.CbTokenConfig) (token string, err error) {
 	log.Println("Retrieving the token from the aerios-shim module...")
-	fullURL := fmt.Sprintf("%s%s", config.AERIOS_SHIM_URL, SHIM_TOKEN_PATH)
-	res, err := http.Get(fullURL)
+	fullURL := fmt.Sprintf("%s%s", settings.AeriosShimUrl, SHIM_TOKEN_PATH)
+	res, err := s.client.Get(fullURL)
 	if err != nil {
 		log.Println("Error retrieving CB token")
 		return
@@ -53,27 +69,34 @@ func (s *OrionLdAuthSvc) GetTokenFromShim() (token string, err error) {
 		log.Println("Error unmarshalling response body")
 		return
 	}
-	// config.OrionToken.AccessToken = response.Token
-
 	return response.Token, err
 }
 
-func (s *OrionLdAuthSvc) GetTokenFromKeycloak() (token string, err error) {
-	if !config.OrionToken.IsTokenExpired() {
-		log.Println("The stored token is still valid")
-		return config.OrionToken.AccessToken, nil
-	}
-
+func (s *OrionLdAuthSvc) GetTokenFromKeycloak(settings config.CbTokenConfig) (token string, expiresIn time.Duration, err error) {
 	log.Println("Retrieving the token from Keycloak...")
-	fullURL := fmt.Sprintf("%s%s%s%s", config.KEYCLOAK_URL, KEYCLOAK_REALM_PATH, config.KEYCLOAK_REALM, KEYCLOAK_TOKEN_PATH)
-	payload := strings.NewReader("client_id=" + config.CB_OAUTH_CLIENT_ID + "&client_secret=" + config.CB_OAUTH_CLIENT_SECRET + "&grant_type=client_credentials")
-	req, err := http.NewRequest(http.MethodPost, fullURL, payload)
+	fullURL := fmt.Sprintf("%s%s%s%s", settings.KeycloakUrl, KEYCLOAK_REALM_PATH, settings.KeycloakRealm, KEYCLOAK_TOKEN_PATH)
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", settings.OAuthClientId)
+	if settings.OAuthClientAuthMethod == "private_key_jwt" {
+		// The token endpoint is the audience of the assertion
+		assertion, err := NewClientAssertion(settings.OAuthClientId, fullURL, settings.OAuthPrivateKeyFile, settings.OAuthKeyId)
+		if err != nil {
+			log.Println("Cannot build the client assertion")
+			return "", 0, err
+		}
+		form.Set("client_assertion_type", CLIENT_ASSERTION_TYPE)
+		form.Set("client_assertion", assertion)
+	} else {
+		form.Set("client_secret", settings.OAuthClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, fullURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		log.Println("HTTP client: could not create request")
 		return
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	res, err := http.DefaultClient.Do(req)
+	res, err := s.client.Do(req)
 	if err != nil {
 		log.Println("Error retrieving the CB token")
 		return
@@ -81,9 +104,9 @@ func (s *OrionLdAuthSvc) GetTokenFromKeycloak() (token string, err error) {
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusUnauthorized {
-		return "", errors.New(strconv.Itoa(res.StatusCode) + ": unauthorized, the Keycloak credentials are not valid")
+		return "", 0, errors.New(strconv.Itoa(res.StatusCode) + ": unauthorized, the Keycloak credentials are not valid")
 	} else if res.StatusCode >= http.StatusBadRequest {
-		return "", errors.New(strconv.Itoa(res.StatusCode) + ": not possible to retrieve the token from Keycloak")
+		return "", 0, errors.New(strconv.Itoa(res.StatusCode) + ": not possible to retrieve the token from Keycloak")
 	}
 
 	body, err := io.ReadAll(res.Body)
@@ -97,60 +120,109 @@ func (s *OrionLdAuthSvc) GetTokenFromKeycloak() (token string, err error) {
 		log.Println("Error unmarshalling response body")
 		return
 	}
-	response.ExpiresAt = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
-	config.OrionToken = response
 
-	return response.AccessToken, err
+	return response.AccessToken, time.Duration(response.ExpiresIn) * time.Second, err
 }
 
-func (s *OrionLdAuthSvc) CheckTokenValidityInKeycloak(token string) (validToken bool, err error) {
-	log.Println("Validating the token in Keycloak...")
-	fullURL := fmt.Sprintf("%s%s%s%s", config.KEYCLOAK_URL, KEYCLOAK_REALM_PATH, config.KEYCLOAK_REALM, KEYCLOAK_TOKEN_VALIDATION_PATH)
-
-	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
+// Reads a token mounted as a file, e.g. a Kubernetes projected service account token, which is rotated
+// by the kubelet, so the file is read again on each refresh
+func (s *OrionLdAuthSvc) GetTokenFromFile(settings config.CbTokenConfig) (token string, err error) {
+	log.Println("Reading the token from " + settings.TokenFile + "...")
+	data, err := os.ReadFile(settings.TokenFile)
 	if err != nil {
-		log.Println("HTTP client: could not create request")
+		log.Println("Error reading the token file")
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Println("Error validating the token")
-		return
+	token = strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("the token file " + settings.TokenFile + " is empty")
 	}
-	defer res.Body.Close()
+	return token, nil
+}
 
-	if res.StatusCode == http.StatusUnauthorized {
-		return false, errors.New(strconv.Itoa(res.StatusCode) + ": unauthorized, the token is not valid")
-	} else {
-		return true, nil
+func (s *OrionLdAuthSvc) fetchToken(settings config.CbTokenConfig) (token string, expiresIn time.Duration, err error) {
+	switch settings.Mode {
+	case "shim":
+		token, err = s.GetTokenFromShim(settings)
+	case "keycloak":
+		token, expiresIn, err = s.GetTokenFromKeycloak(settings)
+	case "file":
+		token, err = s.GetTokenFromFile(settings)
+	case "static":
+		// Only intended for development
+		token = settings.StaticToken
+	default:
+		return "", 0, errors.New("the Authentication token retrieval mode has not been configured")
 	}
+	return
 }
 
-func (s *OrionLdAuthSvc) GetAuthToken() (token string, err error) {
-	if config.CB_TOKEN_MODE == "shim" {
-		token, err = s.GetTokenFromShim()
-	} else if config.CB_TOKEN_MODE == "keycloak" {
-		token, err = s.GetTokenFromKeycloak()
-	} else {
-		return "", errors.New("the Authentication token retrieval mode has not been configured")
+// Returns the auth profile of a destination: the first one matching the domain whose Federator is called or
+// the URL, or the default one (empty name) if none matches, e.g. for the calls to the local broker
+func (s *OrionLdAuthSvc) GetAuthProfile(destination *url.URL) string {
+	profiles := s.cfg().AuthProfiles
+	if len(profiles) == 0 {
+		return ""
 	}
-	return
+	destinationUrl := destinationUrl(destination)
+	domain := s.state.FederatorDomain(destinationUrl)
+	for _, profile := range profiles {
+		if matchesDestination(profile.Domains, profile.UrlPatterns, domain, destinationUrl) {
+			return profile.Name
+		}
+	}
+	return ""
 }
 
-func (i *Interceptor) RoundTrip(req *http.Request) (*http.Response, error) {
+// Returns the cached token of an auth profile, which is only retrieved again from its source when it is about to expire
+func (s *OrionLdAuthSvc) GetAuthToken(profile string) (token string, err error) {
+	return s.tokens.Token(profile)
+}
+
+// Discards a token rejected by a destination, so a new one is retrieved. Returns false if the token is kept
+// because it has just been issued.
+func (s *OrionLdAuthSvc) InvalidateAuthToken(profile string, token string) bool {
+	return s.tokens.Invalidate(profile, token)
+}
 
-	// modify before the request is sent
-	accessToken, err := i.orionLdAuthSvc.GetAuthToken()
+func (i *Interceptor) RoundTrip(req *http.Request) (*http.Response, error) {
+	profile := i.orionLdAuthSvc.GetAuthProfile(req.URL)
+	accessToken, err := i.orionLdAuthSvc.GetAuthToken(profile)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Token successfully obtained")
-	// Set the Authorization header with the valid token
 	// req.Header.Set("aerOS", "true")
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := i.core.RoundTrip(withBearerToken(req, accessToken))
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	// The token may have been revoked before its expiry, so the request is retried once with a new token
+	// (only if its body can be sent again)
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+	if !i.orionLdAuthSvc.InvalidateAuthToken(profile, accessToken) {
+		return res, nil
+	}
+	log.Println("The token has been rejected by " + req.URL.Host + ", retrying with a new token...")
+	accessToken, err = i.orionLdAuthSvc.GetAuthToken(profile)
+	if err != nil {
+		return res, nil
+	}
+	retry := withBearerToken(req, accessToken)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return res, nil
+		}
+	}
+	res.Body.Close()
+	return i.core.RoundTrip(retry)
+}
 
-	// send the request using the DefaultTransport
-	return i.core.RoundTrip(req)
+// The RoundTripper must not modify the original request, so the header is set in a copy
+func withBearerToken(req *http.Request, token string) *http.Request {
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", "Bearer "+token)
+	return authorized
 }
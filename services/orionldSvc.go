@@ -11,40 +11,54 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eclipse-aerios/federator/config"
 	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/state"
 )
 
 type OrionldSvc struct {
+	store          *config.Store
+	state          *state.RuntimeState
 	orionLdAuthSvc OrionLdAuthSvc
+	broker         ContextBroker
+	transport      http.RoundTripper
+	client         *http.Client
+}
+
+func NewOrionldSvc(store *config.Store, runtimeState *state.RuntimeState, orionLdAuthSvc OrionLdAuthSvc, circuitBreakers *CircuitBreakerTransport) OrionldSvc {
+	transport := NewJsonLdContextTransport(store, NewTenantTransport(store, circuitBreakers))
+	return OrionldSvc{
+		store:          store,
+		state:          runtimeState,
+		orionLdAuthSvc: orionLdAuthSvc,
+		broker:         NewContextBroker(store.Get().CbType),
+		transport:      transport,
+		client:         &http.Client{Transport: transport},
+	}
+}
+
+func (s *OrionldSvc) cfg() *config.Config {
+	return s.store.Get()
 }
 
 const CSR_PATH = "/ngsi-ld/v1/csourceRegistrations"
 const ENTITIES_PATH = "/ngsi-ld/v1/entities"
 const SOURCE_IDENTITY_PATH = "/ngsi-ld/v1/info/sourceIdentity"
+const TYPES_PATH = "/ngsi-ld/v1/types"
 const VERSION_PATH = "/version"
 
 func (s *OrionldSvc) IsOrionHealthy() (bool, error) {
-	if config.CB_HEALTH_CHECK_MODE == "endpoint" {
-		log.Println("Performing an HTTP GET request to the /version endpoint...")
-		fullURL := fmt.Sprintf("%s%s", config.DOMAIN_CB_URL, VERSION_PATH)
-		res, err := http.Get(fullURL)
-		if err != nil {
-			log.Println("Error reaching the version endpoint")
-			return false, err
-		}
-		defer res.Body.Close()
-		if res.StatusCode != http.StatusOK {
-			return false, errors.New(strconv.Itoa(res.StatusCode) + ": error reaching the version endpoint")
-		}
-		return true, nil
+	if s.cfg().CbHealthCheckMode == "endpoint" {
+		err := s.broker.CheckHealth(s.client, s.cfg().Domain.CbUrl)
+		return err == nil, err
 	} else {
 		log.Println("Orion healthcheck in TCP socket mode")
 		// Connect to the server
-		conn, err := net.Dial("tcp", config.DOMAIN_CB_HEALTH_URL)
+		conn, err := net.Dial("tcp", s.cfg().Domain.CbHealthUrl)
 		if err != nil {
-			config.Status = config.UNHEALTHY_STATUS
 			if conn != nil {
 				// Close the connection
 				conn.Close()
@@ -68,19 +82,37 @@ func (s *OrionldSvc) IsOrionHealthy() (bool, error) {
 
 }
 
-func (s *OrionldSvc) CreateDomainEntity() error {
-	domainOwner, _ := models.NewMultipleRelationship(models.BuildNgsiLdEntityId("Organization", config.DOMAIN_OWNER))
+func (s *OrionldSvc) CreateDomainEntity(status string) error {
+	domainOwner, _ := models.NewMultipleRelationship(models.BuildNgsiLdEntityId("Organization", s.cfg().Domain.Owner))
 	domain := &models.Domain{
-		Id:           models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME),
+		Id:           models.BuildNgsiLdEntityId("Domain", s.cfg().Domain.Name),
 		Type:         "Domain",
-		Description:  config.DOMAIN_DESCRIPTION,
-		PublicUrl:    config.DOMAIN_PUBLIC_URL,
+		Description:  s.cfg().Domain.Description,
+		PublicUrl:    s.cfg().Domain.PublicUrl,
 		Owner:        domainOwner,
-		IsEntrypoint: config.IS_ENTRYPOINT,
-		DomainStatus: models.NewRelationship(config.FUNCTIONAL_DOMAIN_STATUS), // INITIAL_DOMAIN_STATUS
+		IsEntrypoint: s.cfg().IsEntrypoint,
+		DomainStatus: models.NewRelationship(status),
+		BrokerId:     s.state.BrokerId(),
+	}
+	heartbeat := models.NewProperty(time.Now().UTC().Format(time.RFC3339))
+	domain.LastHeartbeat = &heartbeat
+	if s.cfg().Domain.FederatorUrl != "" {
+		domain.FederatorUrl = s.cfg().Domain.FederatorUrl
+	}
+	if s.cfg().Domain.BrokerUrl != "" {
+		domain.BrokerUrl = s.cfg().Domain.BrokerUrl
+	}
+	if s.cfg().Domain.CbTenant != "" {
+		domain.Tenant = s.cfg().Domain.CbTenant
 	}
-	if config.DOMAIN_FEDERATOR_URL != "" {
-		domain.FederatorUrl = config.DOMAIN_FEDERATOR_URL
+	if len(s.cfg().Domain.SharedEntityTypes) > 0 {
+		domain.SharedEntityTypes = &models.SharedEntityTypesProperty{Type: "Property", Value: s.cfg().Domain.SharedEntityTypes}
+	}
+	if len(s.cfg().Domain.Labels) > 0 {
+		domain.Labels = &models.LabelsProperty{Type: "Property", Value: s.cfg().Domain.Labels}
+	}
+	if s.cfg().Domain.Location != nil {
+		domain.Location = &models.GeoProperty{Type: "GeoProperty", Value: *s.cfg().Domain.Location}
 	}
 
 	bodyJson, err := json.Marshal(domain)
@@ -89,8 +121,8 @@ func (s *OrionldSvc) CreateDomainEntity() error {
 		return err
 	}
 
-	fullURL := fmt.Sprintf("%s%s", config.DOMAIN_CB_URL, ENTITIES_PATH)
-	res, err := http.Post(fullURL, "application/json", bytes.NewBuffer(bodyJson))
+	fullURL := fmt.Sprintf("%s%s", s.cfg().Domain.CbUrl, ENTITIES_PATH)
+	res, err := s.client.Post(fullURL, "application/json", bytes.NewBuffer(bodyJson))
 	if err != nil {
 		log.Println("Could not make POST request to the Orion-LD API")
 		return err
@@ -106,9 +138,9 @@ func (s *OrionldSvc) CreateDomainEntity() error {
 
 func (s *OrionldSvc) CreateOrganizationEntity() error {
 	organization := &models.Organization{
-		Id:   models.BuildNgsiLdEntityId("Organization", config.DOMAIN_OWNER),
+		Id:   models.BuildNgsiLdEntityId("Organization", s.cfg().Domain.Owner),
 		Type: "Organization",
-		Name: config.DOMAIN_OWNER,
+		Name: s.cfg().Domain.Owner,
 	}
 	bodyJson, err := json.Marshal(organization)
 	if err != nil {
@@ -116,8 +148,8 @@ func (s *OrionldSvc) CreateOrganizationEntity() error {
 		return err
 	}
 
-	fullURL := fmt.Sprintf("%s%s", config.DOMAIN_CB_URL, ENTITIES_PATH)
-	res, err := http.Post(fullURL, "application/json", bytes.NewBuffer(bodyJson))
+	fullURL := fmt.Sprintf("%s%s", s.cfg().Domain.CbUrl, ENTITIES_PATH)
+	res, err := s.client.Post(fullURL, "application/json", bytes.NewBuffer(bodyJson))
 	if err != nil {
 		log.Println("Could not make POST request to the Orion-LD API")
 		return err
@@ -131,15 +163,21 @@ func (s *OrionldSvc) CreateOrganizationEntity() error {
 	return nil
 }
 
+// Creates the CSRs in the local broker, with an expiry if the CSR leases are enabled
 func (s *OrionldSvc) CreateContextSourceRegistrations(registrations *[]models.ContextSourceRegistration) error {
 	for _, v := range *registrations {
+		// The expiry of the CSRs copied from other brokers (e.g. the peer federator ones) is not kept
+		v.ExpiresAt = ""
+		if s.cfg().CsrLease.Enabled {
+			v.ExpiresAt = s.CsrLeaseExpiry()
+		}
 		bodyJson, err := json.Marshal(v)
 		if err != nil {
 			log.Println("Failed to encode the CSR in JSON")
 			return err
 		}
-		fullURL := fmt.Sprintf("%s%s", config.DOMAIN_CB_URL, CSR_PATH)
-		res, err := http.Post(fullURL, "application/json", bytes.NewBuffer(bodyJson))
+		fullURL := fmt.Sprintf("%s%s", s.cfg().Domain.CbUrl, CSR_PATH)
+		res, err := s.client.Post(fullURL, "application/json", bytes.NewBuffer(bodyJson))
 		if err != nil {
 			log.Println("Could not make POST request to the Orion-LD API")
 			return err
@@ -154,20 +192,39 @@ func (s *OrionldSvc) CreateContextSourceRegistrations(registrations *[]models.Co
 	return nil
 }
 
+// Renders the configured CSR templates for a domain, limited to the entity types it shares
 func (s *OrionldSvc) GenerateContextSourceRegistrations(newDomain *models.NewDomain) (registrations []models.ContextSourceRegistration) {
-	infracrs := models.NewInfrastructureCSR(newDomain)
-	organizationsCrs := models.NewOrganizationCSR(newDomain)
-	servicesCsr := models.NewServicesCSR(newDomain)
-	benchmarkCsr := models.NewBenchmarkCSR(newDomain)
-
-	registrations = append(registrations, infracrs, organizationsCrs, servicesCsr, benchmarkCsr)
+	for _, template := range s.cfg().CsrTemplates {
+		registrations = append(registrations, template.Render(newDomain)...)
+	}
 	return
 }
 
+// Renders the CSRs pointing to a remote domain that the local sharing policy accepts, in auxiliary mode if the
+// domain is in shadow mode
+func (s *OrionldSvc) GenerateAcceptedContextSourceRegistrations(newDomain *models.NewDomain) []models.ContextSourceRegistration {
+	accepted := s.cfg().SharingPolicy.Apply(newDomain, s.cfg().CsrTemplates)
+	// An empty list of shared entity types would mean all of them
+	if len(accepted.SharedEntityTypes) == 0 {
+		return nil
+	}
+	registrations := s.GenerateContextSourceRegistrations(accepted)
+	if _, isShadow := s.state.ShadowDomain(newDomain.Name); !isShadow {
+		return registrations
+	}
+	// The domains in shadow mode are only registered as auxiliary context sources until they are promoted
+	auxiliaryRegistrations := make([]models.ContextSourceRegistration, 0, len(registrations))
+	for _, registration := range registrations {
+		if auxiliary, hasRetrieval := registration.Auxiliary(); hasRetrieval {
+			auxiliaryRegistrations = append(auxiliaryRegistrations, auxiliary)
+		}
+	}
+	return auxiliaryRegistrations
+}
+
 func (s *OrionldSvc) GetDomainEntities(format string, count bool, attrs string, q string, options string, idPattern string) (domains []models.DomainSimplified, resultsCount int, err error) {
 	queryParams := url.Values{}
 	queryParams.Add("type", "Domain")
-	queryParams.Add("format", format)
 	queryParams.Add("count", strconv.FormatBool(count))
 	if attrs != "" {
 		queryParams.Add("attrs", attrs)
@@ -181,19 +238,20 @@ func (s *OrionldSvc) GetDomainEntities(format string, count bool, attrs string,
 	if idPattern != "" {
 		queryParams.Add("idPattern", idPattern)
 	}
+	s.broker.SetFormat(queryParams, format)
 
 	log.Println("Retrieving Domain entities from the continuum...")
-	fullURL := fmt.Sprintf("%s?%s", config.DOMAIN_CB_URL+ENTITIES_PATH, queryParams.Encode())
+	fullURL := fmt.Sprintf("%s?%s", s.cfg().Domain.CbUrl+ENTITIES_PATH, queryParams.Encode())
 	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
 	if err != nil {
 		log.Println("HTTP client: could not create request")
 		return
 	}
-	req.Header.Set("aerOS", "true")
+	s.broker.SetFederated(req)
 
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           s.transport,
 			orionLdAuthSvc: s.orionLdAuthSvc,
 		},
 	}
@@ -220,7 +278,16 @@ func (s *OrionldSvc) GetDomainEntities(format string, count bool, attrs string,
 		log.Printf("Error reading response body: %v", err)
 		return
 	}
-	_ = json.Unmarshal(body, &domains)
+	err = json.Unmarshal(body, &domains)
+	if err != nil {
+		log.Println("Error unmarshalling response body")
+		return nil, 0, err
+	}
+	for _, domain := range domains {
+		if domain.PublicUrl != "" || domain.FederatorUrl != "" {
+			s.state.SetFederatorDomain(domain.GetFederatorUrl(), models.GetNgsiLdEntityIdValue("Domain", domain.Id))
+		}
+	}
 
 	return domains, resultsCount, err
 }
@@ -228,18 +295,18 @@ func (s *OrionldSvc) GetDomainEntities(format string, count bool, attrs string,
 func (s *OrionldSvc) GetLocalDomainEntity(format string, attrs string, options string) (domain *models.DomainSimplified, err error) {
 	queryParams := url.Values{}
 	// queryParams.Add("type", "Domain")
-	queryParams.Add("local", "true")
-	queryParams.Add("format", format)
+	s.broker.SetLocal(queryParams)
 	if attrs != "" {
 		queryParams.Add("attrs", attrs)
 	}
 	if options != "" {
 		queryParams.Add("options", options)
 	}
+	s.broker.SetFormat(queryParams, format)
 
 	log.Println("Retrieving the local Domain entity...")
-	fullURL := fmt.Sprintf("%s%s/%s?%s", config.DOMAIN_CB_URL, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME), queryParams.Encode())
-	res, err := http.Get(fullURL)
+	fullURL := fmt.Sprintf("%s%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", s.cfg().Domain.Name), queryParams.Encode())
+	res, err := s.client.Get(fullURL)
 	if err != nil {
 		log.Println("Error retrieving local Domain entity")
 		return
@@ -257,7 +324,11 @@ func (s *OrionldSvc) GetLocalDomainEntity(format string, attrs string, options s
 		log.Printf("Error reading response body: %v", err)
 		return
 	}
-	_ = json.Unmarshal(body, &domain)
+	err = json.Unmarshal(body, &domain)
+	if err != nil {
+		log.Println("Error unmarshalling response body")
+		return nil, err
+	}
 
 	return domain, err
 }
@@ -266,11 +337,11 @@ func (s *OrionldSvc) ExistsLocalDomainEntity() (exists bool, err error) {
 	queryParams := url.Values{}
 	queryParams.Add("type", "Domain")
 	// queryParams.Add("onlyIds", strconv.FormatBool(true))
-	queryParams.Add("local", "true")
+	s.broker.SetLocal(queryParams)
 
 	log.Println("Retrieving the local Domain entity...")
-	fullURL := fmt.Sprintf("%s%s/%s?%s", config.DOMAIN_CB_URL, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME), queryParams.Encode())
-	res, err := http.Get(fullURL)
+	fullURL := fmt.Sprintf("%s%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", s.cfg().Domain.Name), queryParams.Encode())
+	res, err := s.client.Get(fullURL)
 	if err != nil {
 		log.Println("Error retrieving local Domain entity")
 		return
@@ -289,21 +360,21 @@ func (s *OrionldSvc) ExistsLocalDomainEntity() (exists bool, err error) {
 func (s *OrionldSvc) ExistsDomainInTheContinuum(domain string) (exists bool, err error) {
 	queryParams := url.Values{}
 	queryParams.Add("type", "Domain")
-	queryParams.Add("format", "simplified")
 	queryParams.Add("attrs", "isEntrypoint")
+	s.broker.SetFormat(queryParams, "simplified")
 
 	log.Println("Retrieving the Domain entity...")
-	fullURL := fmt.Sprintf("%s%s/%s?%s", config.DOMAIN_CB_URL, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", domain), queryParams.Encode())
+	fullURL := fmt.Sprintf("%s%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", domain), queryParams.Encode())
 	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
 	if err != nil {
 		log.Println("HTTP client: could not create request")
 		return
 	}
-	req.Header.Set("aerOS", "true")
+	s.broker.SetFederated(req)
 
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           s.transport,
 			orionLdAuthSvc: s.orionLdAuthSvc,
 		},
 	}
@@ -326,20 +397,20 @@ func (s *OrionldSvc) ExistsDomainInTheContinuum(domain string) (exists bool, err
 func (s *OrionldSvc) ExistsOrganizationInTheContinuum(organization string) (exists bool, err error) {
 	queryParams := url.Values{}
 	queryParams.Add("type", "Organization")
-	queryParams.Add("format", "simplified")
+	s.broker.SetFormat(queryParams, "simplified")
 
 	log.Println("Retrieving the Organization entity...")
-	fullURL := fmt.Sprintf("%s%s/%s?%s", config.DOMAIN_CB_URL, ENTITIES_PATH, models.BuildNgsiLdEntityId("Organization", organization), queryParams.Encode())
+	fullURL := fmt.Sprintf("%s%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Organization", organization), queryParams.Encode())
 	req, err := http.NewRequest(http.MethodGet, fullURL, nil)
 	if err != nil {
 		log.Println("HTTP client: could not create request")
 		return
 	}
-	req.Header.Set("aerOS", "true")
+	s.broker.SetFederated(req)
 
 	client := &http.Client{
 		Transport: &Interceptor{
-			core:           http.DefaultTransport,
+			core:           s.transport,
 			orionLdAuthSvc: s.orionLdAuthSvc,
 		},
 	}
@@ -369,8 +440,8 @@ func (s *OrionldSvc) GetAeriosContextSourceRegistrations(csf string, count bool)
 	}
 
 	log.Println("Retrieving local aeriOS federation CSRs...")
-	fullURL := fmt.Sprintf("%s?%s", config.DOMAIN_CB_URL+CSR_PATH, queryParams.Encode())
-	res, err := http.Get(fullURL)
+	fullURL := fmt.Sprintf("%s?%s", s.cfg().Domain.CbUrl+CSR_PATH, queryParams.Encode())
+	res, err := s.client.Get(fullURL)
 	if err != nil {
 		log.Println("Error retrieving CSRs")
 		return
@@ -393,14 +464,18 @@ func (s *OrionldSvc) GetAeriosContextSourceRegistrations(csf string, count bool)
 		log.Printf("Error reading response body: %v", err)
 		return
 	}
-	_ = json.Unmarshal(body, &registrations)
+	err = json.Unmarshal(body, &registrations)
+	if err != nil {
+		log.Println("Error unmarshalling response body")
+		return nil, err
+	}
 
 	return registrations, err
 }
 
 func (s *OrionldSvc) UpdateLocalDomainStatus(status string) (err error) {
 	queryParams := url.Values{}
-	queryParams.Add("local", "true")
+	s.broker.SetLocal(queryParams)
 
 	log.Println("Updating the local Domain entity...")
 
@@ -411,7 +486,7 @@ func (s *OrionldSvc) UpdateLocalDomainStatus(status string) (err error) {
 		return
 	}
 
-	fullURL := fmt.Sprintf("%s%s/%s/%s?%s", config.DOMAIN_CB_URL, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME), "attrs/domainStatus", queryParams.Encode())
+	fullURL := fmt.Sprintf("%s%s/%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", s.cfg().Domain.Name), "attrs/domainStatus", queryParams.Encode())
 	req, err := http.NewRequest(http.MethodPatch, fullURL, bytes.NewBuffer(bodyJSON))
 	if err != nil {
 		log.Println("HTTP client: could not create request")
@@ -419,7 +494,7 @@ func (s *OrionldSvc) UpdateLocalDomainStatus(status string) (err error) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := s.client.Do(req)
 	if err != nil {
 		log.Println("Error updating local Domain entity")
 		return
@@ -434,12 +509,50 @@ func (s *OrionldSvc) UpdateLocalDomainStatus(status string) (err error) {
 	return
 }
 
+// Renews the lease of the local domain by refreshing the lastHeartbeat attribute of its Domain entity
+func (s *OrionldSvc) RenewLocalDomainLease() (err error) {
+	queryParams := url.Values{}
+	s.broker.SetLocal(queryParams)
+
+	// POST is used instead of PATCH to also append the attribute to Domain entities created before leases existed
+	body := map[string]models.Property{
+		"lastHeartbeat": models.NewProperty(time.Now().UTC().Format(time.RFC3339)),
+	}
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		log.Println("Failed to create request body")
+		return
+	}
+
+	fullURL := fmt.Sprintf("%s%s/%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", s.cfg().Domain.Name), "attrs", queryParams.Encode())
+	req, err := http.NewRequest(http.MethodPost, fullURL, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		log.Println("HTTP client: could not create request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		log.Println("Error renewing the lease of the local Domain entity")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errors.New(strconv.Itoa(res.StatusCode) + ": domain entity not found")
+	} else if res.StatusCode >= 400 {
+		return errors.New(strconv.Itoa(res.StatusCode) + ": error renewing the local domain lease")
+	}
+	return
+}
+
 func (s *OrionldSvc) DeleteLocalDomainEntity() (err error) {
 	queryParams := url.Values{}
-	queryParams.Add("local", "true")
+	s.broker.SetLocal(queryParams)
 
 	log.Println("Deleting local Domain entity ...")
-	fullURL := fmt.Sprintf("%s%s/%s?%s", config.DOMAIN_CB_URL, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", config.DOMAIN_NAME), queryParams.Encode())
+	fullURL := fmt.Sprintf("%s%s/%s?%s", s.cfg().Domain.CbUrl, ENTITIES_PATH, models.BuildNgsiLdEntityId("Domain", s.cfg().Domain.Name), queryParams.Encode())
 
 	req, err := http.NewRequest(http.MethodDelete, fullURL, nil)
 	if err != nil {
@@ -447,9 +560,10 @@ func (s *OrionldSvc) DeleteLocalDomainEntity() (err error) {
 		return
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := s.client.Do(req)
 	if err != nil {
 		log.Println("Error deleting Domain entity")
+		return
 	}
 	defer res.Body.Close()
 
@@ -463,7 +577,7 @@ func (s *OrionldSvc) DeleteLocalDomainEntity() (err error) {
 
 func (s *OrionldSvc) DeleteContextSourceRegistration(regId string) (err error) {
 	log.Println("Deleting local CSR " + regId + "...")
-	fullURL := fmt.Sprintf("%s%s/%s", config.DOMAIN_CB_URL, CSR_PATH, regId)
+	fullURL := fmt.Sprintf("%s%s/%s", s.cfg().Domain.CbUrl, CSR_PATH, regId)
 
 	req, err := http.NewRequest(http.MethodDelete, fullURL, nil)
 	if err != nil {
@@ -471,9 +585,10 @@ func (s *OrionldSvc) DeleteContextSourceRegistration(regId string) (err error) {
 		return
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := s.client.Do(req)
 	if err != nil {
 		log.Println("Error deleting CSR")
+		return
 	}
 	defer res.Body.Close()
 
@@ -485,6 +600,42 @@ func (s *OrionldSvc) DeleteContextSourceRegistration(regId string) (err error) {
 	return
 }
 
+// Returns the expiry of a CSR created or renewed now
+func (s *OrionldSvc) CsrLeaseExpiry() string {
+	return time.Now().UTC().Add(s.cfg().CsrLease.Duration).Format(time.RFC3339)
+}
+
+// Extends the expiry of a local CSR
+func (s *OrionldSvc) RenewContextSourceRegistration(regId string, expiresAt string) (err error) {
+	bodyJSON, err := json.Marshal(map[string]string{"expiresAt": expiresAt})
+	if err != nil {
+		log.Println("Failed to create request body")
+		return
+	}
+
+	fullURL := fmt.Sprintf("%s%s/%s", s.cfg().Domain.CbUrl, CSR_PATH, regId)
+	req, err := http.NewRequest(http.MethodPatch, fullURL, bytes.NewBuffer(bodyJSON))
+	if err != nil {
+		log.Println("HTTP client: could not create request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		log.Println("Error renewing CSR")
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errors.New(strconv.Itoa(res.StatusCode) + ": CSR not found")
+	} else if res.StatusCode >= 400 {
+		return errors.New(strconv.Itoa(res.StatusCode) + ": error renewing CSR")
+	}
+	return
+}
+
 func (s *OrionldSvc) DeleteAeriosContextSourceRegistrations() (err error) {
 	log.Println("Retrieving local aeriOS CSRs...")
 	localRegistrations, err := s.GetAeriosContextSourceRegistrations("", true)
@@ -523,30 +674,28 @@ func (s *OrionldSvc) DeleteAeriosDomainContextSourceRegistrations(domain string)
 	return err
 }
 
-func (s *OrionldSvc) GetSourceIdentity() (sourceIdentity *models.SourceIdentity, err error) {
-	log.Println("Retrieving the Source Identity of the broker...")
-	fullURL := fmt.Sprintf("%s%s", config.DOMAIN_CB_URL, SOURCE_IDENTITY_PATH)
-	res, err := http.Get(fullURL)
-	if err != nil {
-		log.Println("Error retrieving Source Identity of the broker")
-		return
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode >= 400 {
-		return sourceIdentity, errors.New(strconv.Itoa(res.StatusCode) + ": error retrieving Source Identity of the broker")
+// Creates again the CSRs pointing to a remote domain that were previously deleted (e.g. a suspended domain), skipping the ones already present
+func (s *OrionldSvc) RestoreAeriosDomainContextSourceRegistrations(domain *models.DomainSimplified) (err error) {
+	log.Println("Restoring local CSRs pointing to domain " + domain.Id + "...")
+	registrations := s.GenerateAcceptedContextSourceRegistrations(models.NewDomainFromEntity(domain))
+	for _, reg := range registrations {
+		regErr := s.CreateContextSourceRegistrations(&[]models.ContextSourceRegistration{reg})
+		if regErr != nil && !strings.HasPrefix(regErr.Error(), strconv.Itoa(http.StatusConflict)) {
+			log.Println(regErr)
+			err = regErr
+		}
 	}
+	return err
+}
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return
-	}
-	err = json.Unmarshal(body, &sourceIdentity)
-	if err != nil {
-		log.Println("Error unmarshalling response body")
-		return
+// Returns the identity of the local broker. The brokers without source identity are identified by the name of
+// the domain, which is then used as the hostAlias of the CSRs pointing to it.
+func (s *OrionldSvc) GetSourceIdentity() (*models.SourceIdentity, error) {
+	log.Println("Retrieving the Source Identity of the broker...")
+	sourceIdentity, err := s.broker.GetSourceIdentity(s.client, s.cfg().Domain.CbUrl)
+	if errors.Is(err, ErrNoSourceIdentity) {
+		log.Println("The broker has no Source Identity, so it is identified by the name of the domain")
+		return &models.SourceIdentity{Type: "ContextSourceIdentity", ContextSourceAlias: s.cfg().Domain.Name}, nil
 	}
-
 	return sourceIdentity, err
 }
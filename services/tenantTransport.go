@@ -0,0 +1,34 @@
+package services
+
+import (
+	"net/http"
+
+	"github.com/eclipse-aerios/federator/config"
+)
+
+const TENANT_HEADER = "NGSILD-Tenant"
+
+// Transport that sends the NGSI-LD tenant of the local broker in every request, so the entities and CSRs of
+// the federation are kept in that tenant (the default one if no tenant is configured)
+type TenantTransport struct {
+	store *config.Store
+	core  http.RoundTripper
+}
+
+func NewTenantTransport(store *config.Store, core http.RoundTripper) *TenantTransport {
+	return &TenantTransport{
+		store: store,
+		core:  core,
+	}
+}
+
+func (t *TenantTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tenant := t.store.Get().Domain.CbTenant
+	if tenant == "" {
+		return t.core.RoundTrip(req)
+	}
+	// The RoundTripper must not modify the original request
+	withTenant := req.Clone(req.Context())
+	withTenant.Header.Set(TENANT_HEADER, tenant)
+	return t.core.RoundTrip(withTenant)
+}
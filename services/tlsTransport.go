@@ -0,0 +1,85 @@
+package services
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/state"
+)
+
+// Transport of all the outbound calls (brokers, Federators, Keycloak and shim), which uses the TLS settings
+// of the first override matching the destination, or the global ones. The TLS settings are only applied at
+// startup, so the transports are built once.
+type TlsTransport struct {
+	state      *state.RuntimeState
+	overrides  []config.TlsOverrideConfig
+	transports []*http.Transport
+	defaults   *http.Transport
+}
+
+func NewTlsTransport(cfg *config.Config, runtimeState *state.RuntimeState) (*TlsTransport, error) {
+	t := &TlsTransport{
+		state:     runtimeState,
+		overrides: cfg.Tls.Overrides,
+	}
+	var certificates []tls.Certificate
+	if cfg.Tls.ClientCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.Tls.ClientCertFile, cfg.Tls.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	var err error
+	if t.defaults, err = newTlsTransport(cfg.TlsCertificateValidation, certificates, cfg.Tls.CaFile); err != nil {
+		return nil, err
+	}
+	if !cfg.TlsCertificateValidation {
+		log.Println("TLS certificate validation is disabled for the outbound calls (TLS_CERTIFICATE_VALIDATION)")
+	}
+	for _, override := range cfg.Tls.Overrides {
+		validation := cfg.TlsCertificateValidation
+		if override.CertificateValidation != nil {
+			validation = *override.CertificateValidation
+		}
+		transport, err := newTlsTransport(validation, certificates, cfg.Tls.CaFile, override.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		if !validation {
+			log.Println("TLS certificate validation is disabled for the destinations of the TLS override " + override.Name)
+		}
+		t.transports = append(t.transports, transport)
+	}
+	return t, nil
+}
+
+func newTlsTransport(certificateValidation bool, certificates []tls.Certificate, caFiles ...string) (*http.Transport, error) {
+	rootCAs, err := config.LoadCaBundle(caFiles...)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:            rootCAs,
+		Certificates:       certificates,
+		InsecureSkipVerify: !certificateValidation,
+	}
+	return transport, nil
+}
+
+func (t *TlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.overrides) > 0 {
+		destination := destinationUrl(req.URL)
+		domain := t.state.FederatorDomain(destination)
+		for i, override := range t.overrides {
+			if matchesDestination(override.Domains, override.UrlPatterns, domain, destination) {
+				return t.transports[i].RoundTrip(req)
+			}
+		}
+	}
+	return t.defaults.RoundTrip(req)
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/state"
+)
+
+// Lifetime of the tokens whose expiry is neither provided by the source nor included in the token (opaque tokens)
+const DEFAULT_TOKEN_LIFETIME = 5 * time.Minute
+
+// Minimum age of a token before it can be discarded after being rejected, so a destination that keeps
+// rejecting the tokens (e.g. because of a wrong audience) doesn't cause a new token per request
+const MIN_TOKEN_AGE_TO_INVALIDATE = 30 * time.Second
+
+// Retrieves a token from its source, along with its lifetime if the source provides it (0 otherwise)
+type TokenSource func(settings config.CbTokenConfig) (token string, expiresIn time.Duration, err error)
+
+// Caches the tokens attached to the outbound requests, one per auth profile, and refreshes them ahead of
+// their expiry, whatever the token mode is. Concurrent refreshes of a profile are collapsed into a single
+// call to its token source.
+type TokenManager struct {
+	store     *config.Store
+	state     *state.RuntimeState
+	source    TokenSource
+	mutex     sync.Mutex
+	refreshes map[string]*tokenRefresh
+}
+
+type tokenRefresh struct {
+	done  chan struct{}
+	token models.AccessToken
+	err   error
+}
+
+func NewTokenManager(store *config.Store, runtimeState *state.RuntimeState, source TokenSource) *TokenManager {
+	return &TokenManager{
+		store:     store,
+		state:     runtimeState,
+		source:    source,
+		refreshes: make(map[string]*tokenRefresh),
+	}
+}
+
+// Returns the cached token of an auth profile, refreshing it first if it is about to expire
+func (m *TokenManager) Token(profile string) (string, error) {
+	token := m.state.Token(profile)
+	if !token.NeedsRefresh() {
+		return token.Value, nil
+	}
+	refreshed, err := m.refreshToken(profile)
+	if err != nil {
+		if !token.IsExpired() {
+			log.Println("Cannot refresh the token, the cached one is used until it expires: " + err.Error())
+			return token.Value, nil
+		}
+		return "", err
+	}
+	return refreshed.Value, nil
+}
+
+// Discards the cached token after a destination has rejected it, unless it has already been replaced or it
+// has just been issued. Returns false if the rejected token is still the cached one.
+func (m *TokenManager) Invalidate(profile string, rejected string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	token := m.state.Token(profile)
+	if token.Value != rejected {
+		return true
+	}
+	if time.Since(token.IssuedAt) < MIN_TOKEN_AGE_TO_INVALIDATE {
+		log.Println("The rejected token has just been issued, so it is not replaced yet")
+		return false
+	}
+	m.state.InvalidateToken(profile)
+	return true
+}
+
+func (m *TokenManager) refreshToken(profile string) (models.AccessToken, error) {
+	m.mutex.Lock()
+	if refresh, inProgress := m.refreshes[profile]; inProgress {
+		m.mutex.Unlock()
+		<-refresh.done
+		return refresh.token, refresh.err
+	}
+	refresh := &tokenRefresh{done: make(chan struct{})}
+	m.refreshes[profile] = refresh
+	m.mutex.Unlock()
+
+	refresh.token, refresh.err = m.newToken(profile)
+
+	m.mutex.Lock()
+	if refresh.err == nil {
+		m.state.SetToken(profile, refresh.token)
+	}
+	delete(m.refreshes, profile)
+	m.mutex.Unlock()
+	close(refresh.done)
+	return refresh.token, refresh.err
+}
+
+func (m *TokenManager) newToken(profile string) (models.AccessToken, error) {
+	settings, exists := m.store.Get().TokenSettings(profile)
+	if !exists {
+		return models.AccessToken{}, errors.New("the auth profile " + profile + " is not configured")
+	}
+	value, expiresIn, err := m.source(settings)
+	if err != nil {
+		return models.AccessToken{}, err
+	}
+	now := time.Now()
+	token := models.AccessToken{Value: value, IssuedAt: now, ExpiresAt: now.Add(expiresIn)}
+	if expiresIn <= 0 {
+		if expiresAt, ok := jwtExpiry(value); ok {
+			token.ExpiresAt = expiresAt
+		} else {
+			token.ExpiresAt = now.Add(DEFAULT_TOKEN_LIFETIME)
+		}
+	}
+	lifetime := token.ExpiresAt.Sub(now)
+	if lifetime <= 0 {
+		return models.AccessToken{}, errors.New("the token obtained is already expired (valid until " + token.ExpiresAt.Format(time.RFC3339) + ")")
+	}
+	// Short-lived tokens are refreshed at the half of their lifetime at the latest
+	margin := max(settings.RefreshMargin, 0)
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	token.RefreshAt = token.ExpiresAt.Add(-margin)
+	log.Println("New token obtained, valid until " + token.ExpiresAt.Format(time.RFC3339))
+	return token, nil
+}
+
+// Returns the expiry of a JWT from its exp claim, without verifying the token
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	claims := struct {
+		Exp float64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(claims.Exp), 0), true
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/state"
+)
+
+// Returns an unsigned JWT with the exp claim
+func testJwt(expiresAt time.Time) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"none"}`)) + "." + encode([]byte(`{"exp":`+strconv.FormatInt(expiresAt.Unix(), 10)+`}`)) + "."
+}
+
+func newTestTokenManager(refreshMargin time.Duration, source TokenSource) (*TokenManager, *state.RuntimeState) {
+	cfg := config.Default()
+	cfg.CbToken.RefreshMargin = refreshMargin
+	runtimeState := state.NewRuntimeState(cfg)
+	return NewTokenManager(config.NewStore(cfg, nil), runtimeState, source), runtimeState
+}
+
+func TestTokenManagerRefreshMargin(t *testing.T) {
+	tests := []struct {
+		name         string
+		margin       time.Duration
+		token        string
+		expiresIn    time.Duration
+		wantLifetime time.Duration
+		wantMargin   time.Duration
+		wantErr      bool
+	}{
+		{name: "lifetime of the source", margin: 30 * time.Second, token: "opaque", expiresIn: 10 * time.Minute, wantLifetime: 10 * time.Minute, wantMargin: 30 * time.Second},
+		{name: "exp claim of the JWT", margin: 30 * time.Second, token: testJwt(time.Now().Add(time.Hour)), wantLifetime: time.Hour, wantMargin: 30 * time.Second},
+		{name: "default lifetime of the opaque tokens", margin: 30 * time.Second, token: "opaque", wantLifetime: DEFAULT_TOKEN_LIFETIME, wantMargin: 30 * time.Second},
+		{name: "margin capped at the half of the lifetime", margin: 30 * time.Second, token: "opaque", expiresIn: 40 * time.Second, wantLifetime: 40 * time.Second, wantMargin: 20 * time.Second},
+		{name: "negative margin clamped at 0", margin: -time.Minute, token: "opaque", expiresIn: 10 * time.Minute, wantLifetime: 10 * time.Minute, wantMargin: 0},
+		{name: "expired JWT", margin: 30 * time.Second, token: testJwt(time.Now().Add(-time.Minute)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, runtimeState := newTestTokenManager(tt.margin, func(settings config.CbTokenConfig) (string, time.Duration, error) {
+				return tt.token, tt.expiresIn, nil
+			})
+
+			value, err := manager.Token("")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			token := runtimeState.Token("")
+			if value != tt.token || token.Value != tt.token {
+				t.Errorf("the token of the source is not returned and cached")
+			}
+			// The exp claim has a precision of seconds
+			if lifetime := token.ExpiresAt.Sub(token.IssuedAt); lifetime < tt.wantLifetime-time.Second || lifetime > tt.wantLifetime {
+				t.Errorf("got lifetime %s, want %s", lifetime, tt.wantLifetime)
+			}
+			if margin := token.ExpiresAt.Sub(token.RefreshAt); margin != tt.wantMargin {
+				t.Errorf("got refresh margin %s, want %s", margin, tt.wantMargin)
+			}
+		})
+	}
+}
+
+func TestTokenManagerRefresh(t *testing.T) {
+	tests := []struct {
+		name       string
+		cached     models.AccessToken
+		sourceErr  error
+		want       string
+		wantErr    bool
+		wantCalled bool
+	}{
+		{
+			name:   "valid cached token",
+			cached: models.AccessToken{Value: "cached", ExpiresAt: time.Now().Add(time.Hour), RefreshAt: time.Now().Add(time.Hour)},
+			want:   "cached",
+		},
+		{
+			name:       "cached token within the margin",
+			cached:     models.AccessToken{Value: "cached", ExpiresAt: time.Now().Add(time.Minute), RefreshAt: time.Now().Add(-time.Second)},
+			want:       "new",
+			wantCalled: true,
+		},
+		{
+			name:       "cached token kept until it expires if the refresh fails",
+			cached:     models.AccessToken{Value: "cached", ExpiresAt: time.Now().Add(time.Minute), RefreshAt: time.Now().Add(-time.Second)},
+			sourceErr:  errors.New("401: unauthorized"),
+			want:       "cached",
+			wantCalled: true,
+		},
+		{
+			name:       "expired cached token",
+			cached:     models.AccessToken{Value: "cached", ExpiresAt: time.Now().Add(-time.Second), RefreshAt: time.Now().Add(-time.Minute)},
+			sourceErr:  errors.New("401: unauthorized"),
+			wantErr:    true,
+			wantCalled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			manager, runtimeState := newTestTokenManager(30*time.Second, func(settings config.CbTokenConfig) (string, time.Duration, error) {
+				called = true
+				return "new", time.Hour, tt.sourceErr
+			})
+			runtimeState.SetToken("", tt.cached)
+
+			value, err := manager.Token("")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if value != tt.want {
+				t.Errorf("got token %q, want %q", value, tt.want)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("got source called %t, want %t", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestTokenManagerSingleFlight(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	manager, _ := newTestTokenManager(30*time.Second, func(settings config.CbTokenConfig) (string, time.Duration, error) {
+		calls.Add(1)
+		<-release
+		return "new", time.Hour, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if value, err := manager.Token(""); err != nil || value != "new" {
+				t.Errorf("got token %q and error %v", value, err)
+			}
+		}()
+	}
+	// Let the calls wait for the refresh in progress
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("got %d calls to the token source, want 1", calls.Load())
+	}
+}
+
+func TestTokenManagerInvalidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		issuedAt      time.Time
+		rejected      string
+		want          bool
+		wantDiscarded bool
+	}{
+		{name: "rejected cached token", issuedAt: time.Now().Add(-time.Minute), rejected: "cached", want: true, wantDiscarded: true},
+		{name: "token just issued", issuedAt: time.Now(), rejected: "cached", want: false},
+		{name: "token already replaced", issuedAt: time.Now().Add(-time.Minute), rejected: "previous", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager, runtimeState := newTestTokenManager(30*time.Second, nil)
+			runtimeState.SetToken("", models.AccessToken{Value: "cached", IssuedAt: tt.issuedAt, ExpiresAt: time.Now().Add(time.Hour)})
+
+			if got := manager.Invalidate("", tt.rejected); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+			if discarded := runtimeState.Token("").Value == ""; discarded != tt.wantDiscarded {
+				t.Errorf("got token discarded %t, want %t", discarded, tt.wantDiscarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package state
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+)
+
+// Peer federator used to join the continuum and to spread the local domain creation
+type Peer struct {
+	FederatorUrl string
+	Domain       string
+}
+
+// Runtime state of the Federator, discovered or changed while it is running (it is not configuration).
+// It is shared by the API handlers and the background tasks, so it is only accessed through synchronized
+// accessors, and the registered hooks are notified of the changes once the lock has been released.
+type RuntimeState struct {
+	mutex            sync.RWMutex
+	peer             Peer
+	brokerId         string
+	domainStatus     string
+	tokens           map[string]models.AccessToken
+	federatorDomains map[string]string
+	shadowDomains    map[string]models.ShadowDomain
+	peerHooks        []func(previous Peer, current Peer)
+	hooksMutex       sync.RWMutex
+}
+
+func NewRuntimeState(cfg *config.Config) *RuntimeState {
+	return &RuntimeState{
+		peer:             Peer{FederatorUrl: cfg.PeerFederatorUrl},
+		tokens:           make(map[string]models.AccessToken),
+		federatorDomains: make(map[string]string),
+		shadowDomains:    make(map[string]models.ShadowDomain),
+	}
+}
+
+func (s *RuntimeState) Peer() Peer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.peer
+}
+
+// Replaces the peer federator, e.g. when the domain of the current one is deleted
+func (s *RuntimeState) SetPeer(peer Peer) {
+	s.mutex.Lock()
+	previous := s.peer
+	s.peer = peer
+	s.mutex.Unlock()
+	if previous != peer {
+		s.notifyPeerChange(previous, peer)
+	}
+}
+
+// Sets the domain of the peer federator, only if the peer has not been replaced in the meantime
+func (s *RuntimeState) SetPeerDomain(federatorUrl string, domain string) {
+	s.mutex.Lock()
+	previous := s.peer
+	if previous.FederatorUrl != federatorUrl || previous.Domain == domain {
+		s.mutex.Unlock()
+		return
+	}
+	s.peer.Domain = domain
+	current := s.peer
+	s.mutex.Unlock()
+	s.notifyPeerChange(previous, current)
+}
+
+func (s *RuntimeState) BrokerId() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.brokerId
+}
+
+func (s *RuntimeState) SetBrokerId(brokerId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.brokerId = brokerId
+}
+
+// Returns the local domain as it is notified to other Federators
+func (s *RuntimeState) LocalDomain(cfg *config.Config) *models.NewDomain {
+	return &models.NewDomain{
+		Name:              cfg.Domain.Name,
+		PublicUrl:         cfg.Domain.PublicUrl,
+		IsEntrypoint:      cfg.IsEntrypoint,
+		BrokerId:          s.BrokerId(),
+		BrokerUrl:         cfg.Domain.BrokerUrl,
+		FederatorUrl:      cfg.Domain.FederatorUrl,
+		Tenant:            cfg.Domain.CbTenant,
+		SharedEntityTypes: cfg.Domain.SharedEntityTypes,
+		Owner:             cfg.Domain.Owner,
+		Labels:            cfg.Domain.Labels,
+		Location:          cfg.Domain.Location,
+	}
+}
+
+// Returns the last known status of the local Domain entity (empty if it is not known yet)
+func (s *RuntimeState) DomainStatus() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.domainStatus
+}
+
+func (s *RuntimeState) SetDomainStatus(status string) {
+	s.mutex.Lock()
+	previous := s.domainStatus
+	s.domainStatus = status
+	s.mutex.Unlock()
+	if previous == status {
+		return
+	}
+	log.Println("Local domain status changed to " + models.GetNgsiLdEntityIdValue("DomainStatus", status))
+}
+
+// Returns a copy of the cached token of an auth profile (the default one if the name is empty)
+func (s *RuntimeState) Token(profile string) models.AccessToken {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.tokens[profile]
+}
+
+func (s *RuntimeState) SetToken(profile string, token models.AccessToken) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens[profile] = token
+}
+
+// Discards the cached token of an auth profile, so a new one is retrieved in the next call
+func (s *RuntimeState) InvalidateToken(profile string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.tokens, profile)
+}
+
+// Discards the cached tokens of all the auth profiles
+func (s *RuntimeState) InvalidateTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = make(map[string]models.AccessToken)
+}
+
+// Remembers the Federator URL of a domain of the continuum, so the calls to it can be matched to the domain
+func (s *RuntimeState) SetFederatorDomain(federatorUrl string, domain string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.federatorDomains[strings.TrimSuffix(federatorUrl, "/")] = domain
+}
+
+// Returns the domain whose Federator URL is the longest prefix of the URL (empty if none matches), including
+// the peer federator, whose domain is known before the Domain entities are retrieved
+func (s *RuntimeState) FederatorDomain(rawUrl string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	domain, matchLength := "", 0
+	match := func(federatorUrl string, name string) {
+		federatorUrl = strings.TrimSuffix(federatorUrl, "/")
+		if name != "" && len(federatorUrl) > matchLength && (rawUrl == federatorUrl || strings.HasPrefix(rawUrl, federatorUrl+"/")) {
+			domain, matchLength = name, len(federatorUrl)
+		}
+	}
+	match(s.peer.FederatorUrl, s.peer.Domain)
+	for federatorUrl, name := range s.federatorDomains {
+		match(federatorUrl, name)
+	}
+	return domain
+}
+
+// Returns the shadow state of a domain, if it has joined in shadow mode and it has not been promoted yet
+func (s *RuntimeState) ShadowDomain(name string) (models.ShadowDomain, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	shadowDomain, isShadow := s.shadowDomains[name]
+	return shadowDomain, isShadow
+}
+
+// Returns the domains in shadow mode, sorted by name
+func (s *RuntimeState) ShadowDomains() []models.ShadowDomain {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	shadowDomains := make([]models.ShadowDomain, 0, len(s.shadowDomains))
+	for _, shadowDomain := range s.shadowDomains {
+		shadowDomains = append(shadowDomains, shadowDomain)
+	}
+	sort.Slice(shadowDomains, func(i, j int) bool { return shadowDomains[i].Domain < shadowDomains[j].Domain })
+	return shadowDomains
+}
+
+func (s *RuntimeState) SetShadowDomain(shadowDomain models.ShadowDomain) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shadowDomains[shadowDomain.Domain] = shadowDomain
+}
+
+// Removes a domain from the shadow mode (promoted or deleted), returning whether it was in shadow mode
+func (s *RuntimeState) RemoveShadowDomain(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, isShadow := s.shadowDomains[name]
+	delete(s.shadowDomains, name)
+	return isShadow
+}
+
+// Registers a function called after each change of the peer federator or its domain
+func (s *RuntimeState) OnPeerChange(hook func(previous Peer, current Peer)) {
+	s.hooksMutex.Lock()
+	defer s.hooksMutex.Unlock()
+	s.peerHooks = append(s.peerHooks, hook)
+}
+
+func (s *RuntimeState) notifyPeerChange(previous Peer, current Peer) {
+	log.Println("Peer federator changed to " + current.FederatorUrl + " (domain " + current.Domain + ")")
+	s.hooksMutex.RLock()
+	hooks := s.peerHooks
+	s.hooksMutex.RUnlock()
+	for _, hook := range hooks {
+		hook(previous, current)
+	}
+}
+
+// Updates the runtime state derived from the reloaded configuration
+func (s *RuntimeState) OnConfigReload(previous *config.Config, current *config.Config) {
+	if current.PeerFederatorUrl != previous.PeerFederatorUrl {
+		s.SetPeer(Peer{FederatorUrl: current.PeerFederatorUrl})
+	}
+	// The cached tokens were issued with the previous credentials
+	if current.CbToken != previous.CbToken || !reflect.DeepEqual(current.AuthProfiles, previous.AuthProfiles) {
+		s.InvalidateTokens()
+	}
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Background loops of the Federator (e.g. lease renewal, health monitor, reconciliation), which are stopped
+// on shutdown before the domain leaves the continuum, so they don't recreate what the leave removes
+type BackgroundTasks struct {
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped bool
+}
+
+func NewBackgroundTasks() *BackgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &BackgroundTasks{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Runs the task in background, unless the tasks have been stopped
+func (t *BackgroundTasks) Go(task func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		task()
+	}()
+}
+
+// Runs the task in background after each interval until the tasks are stopped (and once at first if
+// runFirst). The interval is read on each iteration, so it can be changed by a hot reload.
+func (t *BackgroundTasks) Every(interval func() time.Duration, runFirst bool, task func()) {
+	t.Go(func() {
+		if runFirst {
+			task()
+		}
+		for {
+			timer := time.NewTimer(interval())
+			select {
+			case <-t.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			task()
+		}
+	})
+}
+
+// Stops the loops and waits for the running iterations to finish, until the context is done.
+// Returns false if some of them are still running.
+func (t *BackgroundTasks) Stop(ctx context.Context) bool {
+	t.mutex.Lock()
+	t.stopped = true
+	t.cancel()
+	t.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"log"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/services"
+)
+
+// Periodically extends the expiry of the local CSRs pointing to the domains that are still federated and
+// healthy, so the CSRs of the dead domains lapse on their own even if their deletion is never notified
+type CsrLeaseRenewer struct {
+	store           *config.Store
+	orionldSvc      services.OrionldSvc
+	disabledDomains *DomainStatusRegistry
+	monitor         *HealthMonitor
+}
+
+func NewCsrLeaseRenewer(store *config.Store, orionldSvc services.OrionldSvc, disabledDomains *DomainStatusRegistry, monitor *HealthMonitor) *CsrLeaseRenewer {
+	return &CsrLeaseRenewer{
+		store:           store,
+		orionldSvc:      orionldSvc,
+		disabledDomains: disabledDomains,
+		monitor:         monitor,
+	}
+}
+
+func (r *CsrLeaseRenewer) cfg() *config.Config {
+	return r.store.Get()
+}
+
+func (r *CsrLeaseRenewer) Start(tasks *BackgroundTasks) {
+	if !r.cfg().CsrLease.Enabled {
+		return
+	}
+	log.Println("Renewing the CSR leases every " + r.cfg().CsrLease.RenewalInterval.String() + ", expiring after " + r.cfg().CsrLease.Duration.String())
+	tasks.Every(func() time.Duration { return r.cfg().CsrLease.RenewalInterval }, false, r.RenewLeases)
+}
+
+// Renews the CSRs of the healthy domains. The ones of the unhealthy or disabled domains are left to expire.
+func (r *CsrLeaseRenewer) RenewLeases() {
+	registrations, err := r.orionldSvc.GetAeriosContextSourceRegistrations("", false)
+	if err != nil {
+		log.Println("Cannot retrieve the local CSRs to renew their leases")
+		log.Println(err)
+		return
+	}
+	expiresAt := r.orionldSvc.CsrLeaseExpiry()
+	for _, registration := range registrations {
+		if r.disabledDomains.IsDisabled(registration.AeriosDomain) || !r.monitor.IsHealthy(registration.AeriosDomain) {
+			continue
+		}
+		if err := r.orionldSvc.RenewContextSourceRegistration(registration.Id, expiresAt); err != nil {
+			log.Println("Cannot renew the lease of CSR " + registration.Id)
+			log.Println(err)
+		}
+	}
+}
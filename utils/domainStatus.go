@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+)
+
+// Local view of the remote domains that have been disabled by this Federator (e.g. expired lease).
+// A domain is disabled while at least one reason is present, so its CSRs are suspended in the local broker
+// when the first reason appears and restored when the last one disappears. The transitions are serialized by
+// their own mutex, so the calls to the broker they make don't block the status checks.
+type DomainStatusRegistry struct {
+	orionldSvc  services.OrionldSvc
+	transitions sync.Mutex
+	mutex       sync.RWMutex
+	domains     map[string]*disabledDomain
+}
+
+type disabledDomain struct {
+	entity  models.DomainSimplified
+	reasons map[string]string
+}
+
+const LEASE_EXPIRED_REASON = "lease"
+
+func NewDomainStatusRegistry(orionldSvc services.OrionldSvc) *DomainStatusRegistry {
+	return &DomainStatusRegistry{
+		orionldSvc: orionldSvc,
+		domains:    make(map[string]*disabledDomain),
+	}
+}
+
+// Disables a remote domain for the given reason, suspending its CSRs if it was not already disabled
+func (r *DomainStatusRegistry) Disable(domain *models.DomainSimplified, reason string, detail string) {
+	domainName := models.GetNgsiLdEntityIdValue("Domain", domain.Id)
+	r.transitions.Lock()
+	defer r.transitions.Unlock()
+
+	r.mutex.Lock()
+	disabled, alreadyDisabled := r.domains[domainName]
+	if !alreadyDisabled {
+		disabled = &disabledDomain{
+			entity:  *domain,
+			reasons: make(map[string]string),
+		}
+		r.domains[domainName] = disabled
+	}
+	_, reasonPresent := disabled.reasons[reason]
+	disabled.reasons[reason] = detail
+	r.mutex.Unlock()
+	if reasonPresent {
+		return
+	}
+	log.Println("Domain " + domainName + " disabled (" + reason + "): " + detail)
+
+	if !alreadyDisabled {
+		log.Println("Suspending the CSRs pointing to domain " + domainName + "...")
+		err := r.orionldSvc.DeleteAeriosDomainContextSourceRegistrations(domainName)
+		if err != nil {
+			log.Println("Cannot suspend the CSRs pointing to domain " + domainName)
+		}
+	}
+}
+
+// Removes a reason to keep a remote domain disabled, restoring its CSRs if no other reason remains
+func (r *DomainStatusRegistry) Enable(domain *models.DomainSimplified, reason string) {
+	domainName := models.GetNgsiLdEntityIdValue("Domain", domain.Id)
+	r.transitions.Lock()
+	defer r.transitions.Unlock()
+
+	r.mutex.Lock()
+	disabled, isDisabled := r.domains[domainName]
+	if !isDisabled {
+		r.mutex.Unlock()
+		return
+	}
+	if _, present := disabled.reasons[reason]; !present {
+		r.mutex.Unlock()
+		return
+	}
+	delete(disabled.reasons, reason)
+	remainingReasons := len(disabled.reasons)
+	r.mutex.Unlock()
+	log.Println("Domain " + domainName + " is no longer disabled by reason: " + reason)
+	if remainingReasons > 0 {
+		return
+	}
+
+	// The domain stays disabled while its CSRs are being restored
+	log.Println("Restoring the CSRs pointing to domain " + domainName + "...")
+	err := r.orionldSvc.RestoreAeriosDomainContextSourceRegistrations(domain)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		// Keep the domain disabled, so the restoration is retried in the next check
+		disabled.reasons[reason] = "CSRs cannot be restored"
+		return
+	}
+	delete(r.domains, domainName)
+}
+
+// Forgets a remote domain (e.g. it has been deleted from the continuum) without touching its CSRs
+func (r *DomainStatusRegistry) Forget(domainName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.domains, domainName)
+}
+
+func (r *DomainStatusRegistry) IsDisabled(domainName string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	_, disabled := r.domains[domainName]
+	return disabled
+}
+
+// Returns the reasons why a remote domain is disabled, sorted and joined as a single string
+func (r *DomainStatusRegistry) Reasons(domainName string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	disabled, isDisabled := r.domains[domainName]
+	if !isDisabled {
+		return ""
+	}
+	reasons := make([]string, 0, len(disabled.reasons))
+	for reason, detail := range disabled.reasons {
+		reasons = append(reasons, reason+": "+detail)
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ", ")
+}
+
+// Returns the last known Domain entities of the disabled domains, which are no longer reachable through the local broker
+func (r *DomainStatusRegistry) Entities() []models.DomainSimplified {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	entities := make([]models.DomainSimplified, 0, len(r.domains))
+	for _, disabled := range r.domains {
+		entities = append(entities, disabled.entity)
+	}
+	return entities
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"log"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/state"
+)
+
+// Background components of the Federator, shared by the API controllers
+type Federator struct {
+	store            *config.Store
+	orionldSvc       services.OrionldSvc
+	federatorSvc     services.FederatorSvc
+	State            *state.RuntimeState
+	Initialization   *Initialization
+	Readiness        *ReadinessChecker
+	DisabledDomains  *DomainStatusRegistry
+	ContinuumMonitor *HealthMonitor
+	RetryOutbox      *Outbox
+	Leases           *LeaseManager
+	Sharing          *SharingReconciler
+	CsrLeases        *CsrLeaseRenewer
+	ShadowDomains    *ShadowManager
+	KnownDomains     *KnownDomainRegistry
+	Tasks            *BackgroundTasks
+}
+
+func NewFederator(store *config.Store, runtimeState *state.RuntimeState, orionldSvc services.OrionldSvc, federatorSvc services.FederatorSvc) *Federator {
+	initialization := NewInitialization(store, runtimeState, orionldSvc, federatorSvc)
+	disabledDomains := NewDomainStatusRegistry(orionldSvc)
+	shadowDomains := NewShadowManager(store, runtimeState, orionldSvc)
+	knownDomains := NewKnownDomainRegistry(store)
+	continuumMonitor := NewHealthMonitor(store, orionldSvc, federatorSvc, disabledDomains, shadowDomains, knownDomains)
+	federator := &Federator{
+		store:            store,
+		orionldSvc:       orionldSvc,
+		federatorSvc:     federatorSvc,
+		State:            runtimeState,
+		Initialization:   initialization,
+		Readiness:        NewReadinessChecker(store, runtimeState, orionldSvc, initialization),
+		DisabledDomains:  disabledDomains,
+		ContinuumMonitor: continuumMonitor,
+		RetryOutbox:      NewOutbox(store, federatorSvc),
+		Leases:           NewLeaseManager(store, orionldSvc, federatorSvc, disabledDomains, knownDomains),
+		Sharing:          NewSharingReconciler(store, orionldSvc, disabledDomains, continuumMonitor, knownDomains),
+		CsrLeases:        NewCsrLeaseRenewer(store, orionldSvc, disabledDomains, continuumMonitor),
+		ShadowDomains:    shadowDomains,
+		KnownDomains:     knownDomains,
+		Tasks:            NewBackgroundTasks(),
+	}
+	runtimeState.OnPeerChange(federator.onPeerChange)
+	return federator
+}
+
+func (f *Federator) cfg() *config.Config {
+	return f.store.Get()
+}
+
+// Starts the background tasks that need an initialized Federator
+func (f *Federator) StartBackgroundTasks() {
+	// The shadow domains are restored before the reconciliation, which would promote them otherwise
+	f.ShadowDomains.Start()
+	f.Leases.Start(f.Tasks)
+	f.ContinuumMonitor.Start(f.Tasks)
+	f.RetryOutbox.Start(f.Tasks)
+	f.Sharing.Start(f.Tasks)
+	f.CsrLeases.Start(f.Tasks)
+}
+
+// Discovers the domain of a new peer federator (e.g. changed by a config reload), unless it is already known
+func (f *Federator) onPeerChange(previous state.Peer, current state.Peer) {
+	if current.FederatorUrl == "" || current.Domain != "" || f.cfg().IsEntrypoint {
+		return
+	}
+	go func() {
+		isPeerFederatorHealthy, peerFederatorDomain, err := f.federatorSvc.CheckFederatorHealth(current.FederatorUrl)
+		if err != nil || !isPeerFederatorHealthy {
+			log.Println("The new peer federator " + current.FederatorUrl + " is not reachable or unhealthy")
+			return
+		}
+		f.State.SetPeerDomain(current.FederatorUrl, peerFederatorDomain)
+	}()
+}
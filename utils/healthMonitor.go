@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+)
+
+// Periodically checks the /health endpoint of the Federator of every federated domain, keeping its
+// reachability, latency and last-seen time. If HEALTH_MONITOR_AUTO_STATUS is enabled, the domains
+// that fail HEALTH_MONITOR_FAILURE_THRESHOLD consecutive checks are disabled until they are reachable again.
+type HealthMonitor struct {
+	store           *config.Store
+	orionldSvc      services.OrionldSvc
+	federatorSvc    services.FederatorSvc
+	disabledDomains *DomainStatusRegistry
+	shadowDomains   *ShadowManager
+	knownDomains    *KnownDomainRegistry
+	mutex           sync.RWMutex
+	domains         map[string]*models.DomainHealth
+}
+
+const HEALTH_CHECK_REASON = "health"
+
+func NewHealthMonitor(store *config.Store, orionldSvc services.OrionldSvc, federatorSvc services.FederatorSvc, disabledDomains *DomainStatusRegistry, shadowDomains *ShadowManager, knownDomains *KnownDomainRegistry) *HealthMonitor {
+	return &HealthMonitor{
+		store:           store,
+		orionldSvc:      orionldSvc,
+		federatorSvc:    federatorSvc,
+		disabledDomains: disabledDomains,
+		shadowDomains:   shadowDomains,
+		knownDomains:    knownDomains,
+		domains:         make(map[string]*models.DomainHealth),
+	}
+}
+
+func (h *HealthMonitor) cfg() *config.Config {
+	return h.store.Get()
+}
+
+func (h *HealthMonitor) Start(tasks *BackgroundTasks) {
+	log.Println("Monitoring the health of the federated domains every " + h.cfg().HealthMonitor.Interval.String())
+	tasks.Every(func() time.Duration { return h.cfg().HealthMonitor.Interval }, true, h.CheckDomains)
+}
+
+// Checks concurrently the Federators of all the federated domains (excluding the local one)
+func (h *HealthMonitor) CheckDomains() {
+	idPattern := "^(?!" + models.BuildNgsiLdEntityId("Domain", h.cfg().Domain.Name) + "$).*$"
+	domains, _, err := h.orionldSvc.GetDomainEntities("simplified", false, "publicUrl,domainStatus,isEntrypoint,federatorUrl,brokerUrl,brokerId,tenant,owner,labels,location,sharedEntityTypes", "", "", idPattern)
+	if err != nil {
+		log.Println("Cannot retrieve the domains to check their health")
+		log.Println(err)
+		return
+	}
+	// The disabled domains and the ones whose CSRs have expired are no longer retrieved through the local
+	// broker, but they must still be monitored
+	domains = append(domains, h.knownDomains.Complete(domains)...)
+	// The removed domains are no longer part of the continuum, even if their entity is still retrieved
+	domains = slices.DeleteFunc(domains, func(domain models.DomainSimplified) bool {
+		return domain.DomainStatus == config.DELETED_DOMAIN_STATUS
+	})
+
+	var wg sync.WaitGroup
+	for i := range domains {
+		wg.Add(1)
+		go func(domain *models.DomainSimplified) {
+			defer wg.Done()
+			h.checkDomain(domain)
+		}(&domains[i])
+	}
+	wg.Wait()
+	h.shadowDomains.CheckDomains()
+
+	// Forget the domains that are no longer part of the continuum
+	h.mutex.Lock()
+	for name := range h.domains {
+		isFederated := false
+		for _, domain := range domains {
+			if models.GetNgsiLdEntityIdValue("Domain", domain.Id) == name {
+				isFederated = true
+				break
+			}
+		}
+		if !isFederated {
+			delete(h.domains, name)
+		}
+	}
+	h.mutex.Unlock()
+}
+
+func (h *HealthMonitor) checkDomain(domain *models.DomainSimplified) {
+	domainName := models.GetNgsiLdEntityIdValue("Domain", domain.Id)
+	federatorUrl := domain.GetFederatorUrl()
+
+	start := time.Now()
+	isHealthy, _, err := h.federatorSvc.CheckFederatorHealth(federatorUrl)
+	latency := time.Since(start)
+
+	h.mutex.Lock()
+	domainHealth, isKnown := h.domains[domainName]
+	if !isKnown {
+		domainHealth = &models.DomainHealth{Domain: domainName}
+		h.domains[domainName] = domainHealth
+	}
+	domainHealth.FederatorUrl = federatorUrl
+	domainHealth.DomainStatus = models.GetNgsiLdEntityIdValue("DomainStatus", domain.DomainStatus)
+	domainHealth.LastChecked = start
+	domainHealth.LatencyMs = latency.Milliseconds()
+	if isHealthy {
+		lastSeen := start
+		domainHealth.Reachable = true
+		domainHealth.Status = config.HEALTHY_STATUS
+		domainHealth.LastSeen = &lastSeen
+		domainHealth.ConsecutiveFailures = 0
+		domainHealth.Message = ""
+	} else {
+		domainHealth.Reachable = err == nil
+		domainHealth.Status = config.UNHEALTHY_STATUS
+		domainHealth.ConsecutiveFailures++
+		if err != nil {
+			domainHealth.Message = err.Error()
+		} else {
+			domainHealth.Message = "The Federator of the domain is unhealthy"
+		}
+	}
+	consecutiveFailures := domainHealth.ConsecutiveFailures
+	h.mutex.Unlock()
+
+	if !h.cfg().HealthMonitor.AutoStatus {
+		return
+	}
+	if isHealthy {
+		h.disabledDomains.Enable(domain, HEALTH_CHECK_REASON)
+	} else if consecutiveFailures >= h.cfg().HealthMonitor.FailureThreshold {
+		h.disabledDomains.Disable(domain, HEALTH_CHECK_REASON, strconv.Itoa(consecutiveFailures)+" consecutive failed health checks")
+	}
+}
+
+// Returns whether a domain is considered healthy, i.e. it has not reached the failure threshold (the domains
+// not checked yet are considered healthy)
+func (h *HealthMonitor) IsHealthy(domainName string) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	domainHealth, isKnown := h.domains[domainName]
+	return !isKnown || domainHealth.ConsecutiveFailures < h.cfg().HealthMonitor.FailureThreshold
+}
+
+// Returns a snapshot of the health of all the monitored domains, sorted by domain name
+func (h *HealthMonitor) DomainsHealth() []models.DomainHealth {
+	h.mutex.RLock()
+	domainsHealth := make([]models.DomainHealth, 0, len(h.domains))
+	for _, domainHealth := range h.domains {
+		domainsHealth = append(domainsHealth, *domainHealth)
+	}
+	h.mutex.RUnlock()
+
+	for i := range domainsHealth {
+		domainsHealth[i].CircuitBreaker = h.federatorSvc.GetCircuitBreakerState(domainsHealth[i].FederatorUrl)
+		// The status of the Domain entity, unless this federator has disabled the domain
+		if h.disabledDomains.IsDisabled(domainsHealth[i].Domain) {
+			domainsHealth[i].DomainStatus = models.GetNgsiLdEntityIdValue("DomainStatus", config.DISABLED_DOMAIN_STATUS)
+		}
+	}
+	sort.Slice(domainsHealth, func(i, j int) bool {
+		return domainsHealth[i].Domain < domainsHealth[j].Domain
+	})
+	return domainsHealth
+}
@@ -3,132 +3,370 @@ package utils
 import (
 	"errors"
 	"log"
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
 	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/state"
 )
 
+const (
+	CHECK_BROKER_STEP        string = "checkBroker"
+	DISCOVER_IDENTITY_STEP   string = "discoverIdentity"
+	CREATE_DOMAIN_STEP       string = "createDomain"
+	SPREAD_STEP              string = "spread"
+	CREATE_ORGANIZATION_STEP string = "createOrganization"
+)
+
+// Initialization of the Federator as a resumable state machine: each step is retried with exponential
+// backoff until it succeeds, so the Federator can be started before the local broker or the peer federator.
+// The local Domain entity is created as Preliminary and only set to Functional once it has been spread,
+// so a Federator restarted in the middle of the process resumes the spreading instead of skipping it.
 type Initialization struct {
+	store        *config.Store
+	state        *state.RuntimeState
 	orionldSvc   services.OrionldSvc
 	federatorSvc services.FederatorSvc
+	mutex        sync.RWMutex
+	progress     models.InitializationProgress
+	domainExists bool
+	spreadDone   bool
+}
+
+type initializationStep struct {
+	name string
+	run  func() error
+}
+
+func NewInitialization(store *config.Store, runtimeState *state.RuntimeState, orionldSvc services.OrionldSvc, federatorSvc services.FederatorSvc) *Initialization {
+	return &Initialization{
+		store:        store,
+		state:        runtimeState,
+		orionldSvc:   orionldSvc,
+		federatorSvc: federatorSvc,
+		progress: models.InitializationProgress{
+			CompletedSteps: make([]string, 0),
+		},
+	}
+}
+
+func (i *Initialization) cfg() *config.Config {
+	return i.store.Get()
+}
+
+func (i *Initialization) steps() []initializationStep {
+	return []initializationStep{
+		{CHECK_BROKER_STEP, i.checkBroker},
+		{DISCOVER_IDENTITY_STEP, i.discoverIdentity},
+		{CREATE_DOMAIN_STEP, i.createDomain},
+		{SPREAD_STEP, i.spread},
+		{CREATE_ORGANIZATION_STEP, i.createOrganization},
+	}
 }
 
-func (i *Initialization) InitializeFederator() (err error) {
+// Runs all the initialization steps, blocking until all of them have succeeded or one of them has failed
+// with an error that retrying cannot fix
+func (i *Initialization) InitializeFederator() error {
 	log.Println("Initializing the aeriOS Federator...")
+	i.mutex.Lock()
+	i.progress.StartedAt = time.Now()
+	i.mutex.Unlock()
 
-	// Check Orion health
-	isOrionHealthy, err := i.orionldSvc.IsOrionHealthy()
-	if err != nil {
-		log.Println(err)
+	for _, step := range i.steps() {
+		if err := i.runStep(step); err != nil {
+			return err
+		}
 	}
+
+	i.mutex.Lock()
+	completedAt := time.Now()
+	i.progress.Completed = true
+	i.progress.CompletedAt = &completedAt
+	i.progress.CurrentStep = ""
+	i.progress.Attempts = 0
+	i.progress.LastError = ""
+	i.mutex.Unlock()
+	return nil
+}
+
+func (i *Initialization) runStep(step initializationStep) error {
+	backoff := i.cfg().Initialization.RetryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		i.mutex.Lock()
+		i.progress.CurrentStep = step.name
+		i.progress.Attempts = attempt
+		i.mutex.Unlock()
+
+		err := step.run()
+		if err == nil {
+			i.mutex.Lock()
+			i.progress.CompletedSteps = append(i.progress.CompletedSteps, step.name)
+			i.progress.LastError = ""
+			i.mutex.Unlock()
+			return nil
+		}
+
+		if isPermanentError(err) {
+			log.Println("Initialization step " + step.name + " failed (attempt " + strconv.Itoa(attempt) + "), not retrying it: " + err.Error())
+			i.mutex.Lock()
+			i.progress.FailedStep = step.name
+			i.progress.LastError = err.Error()
+			i.mutex.Unlock()
+			return err
+		}
+
+		log.Println("Initialization step " + step.name + " failed (attempt " + strconv.Itoa(attempt) + "), retrying in " + backoff.String() + ": " + err.Error())
+		i.mutex.Lock()
+		i.progress.LastError = err.Error()
+		i.mutex.Unlock()
+		time.Sleep(backoff)
+		backoff = min(backoff*2, i.cfg().Initialization.RetryMaxBackoff)
+	}
+}
+
+// Returns true if the error is a 4xx answer that retrying won't change (e.g. a rejected request). The
+// unauthorized, forbidden, timeout and too many requests answers are retried, since they can be fixed
+// without a restart (e.g. by a token refresh or a hot reload of the credentials).
+func isPermanentError(err error) bool {
+	code, _, _ := strings.Cut(err.Error(), ":")
+	statusCode, convErr := strconv.Atoi(code)
+	if convErr != nil || statusCode < 400 || statusCode >= 500 {
+		return false
+	}
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	default:
+		return true
+	}
+}
+
+// Returns a snapshot of the initialization progress
+func (i *Initialization) Progress() models.InitializationProgress {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	progress := i.progress
+	progress.CompletedSteps = append(make([]string, 0, len(i.progress.CompletedSteps)), i.progress.CompletedSteps...)
+	return progress
+}
+
+// Returns true if a step has failed and the initialization has stopped, so it needs a restart
+func (i *Initialization) IsFailed() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.progress.FailedStep != ""
+}
+
+func (i *Initialization) IsCompleted() bool {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.progress.Completed
+}
+
+// Check Orion health
+func (i *Initialization) checkBroker() error {
+	isOrionHealthy, err := i.orionldSvc.IsOrionHealthy()
 	if !isOrionHealthy {
-		log.Panicln("Orion-LD instance of the domain is unhealthy, so the aeriOS Federator cannot be started.")
+		if err == nil {
+			err = errors.New("unknown error")
+		}
+		return errors.New("Orion-LD instance of the domain is unhealthy: " + err.Error())
 	}
+	return nil
+}
 
-	// Get information of the local context broker
+// Get information of the local context broker, the local Domain entity and the peer federator
+func (i *Initialization) discoverIdentity() error {
 	log.Println("Retrieving configuration of the Domain Context Broker (NGSI-LD Source Identity)...")
 	brokerInfo, err := i.orionldSvc.GetSourceIdentity()
 	if err != nil {
 		return err
 	}
 	log.Println("CB Context Source Alias: " + brokerInfo.ContextSourceAlias)
-	config.BROKER_ID = brokerInfo.ContextSourceAlias
-	config.LOCAL_DOMAIN.BrokerId = brokerInfo.ContextSourceAlias
-	// Do we need to check the status of the domain?
-	noNewDomain, err := i.orionldSvc.ExistsLocalDomainEntity()
+	i.state.SetBrokerId(brokerInfo.ContextSourceAlias)
+
+	domainExists, err := i.orionldSvc.ExistsLocalDomainEntity()
 	if err != nil {
-		log.Println("The existence of the local domain entity cannot be checked, so the aeriOS Federator cannot be started.")
+		log.Println("The existence of the local domain entity cannot be checked")
 		return err
 	}
+	i.domainExists = domainExists
+	if domainExists {
+		localDomain, err := i.orionldSvc.GetLocalDomainEntity("simplified", "domainStatus", "")
+		if err != nil {
+			return err
+		}
+		i.state.SetDomainStatus(localDomain.DomainStatus)
+	}
 	// TODO check if the domain exists in the continuum -> panic
 
 	// Check peer federator health
 	log.Println("Checking the health of the peer federator...")
-	if config.IS_ENTRYPOINT {
+	if i.cfg().IsEntrypoint {
 		// TODO check in the future
 		log.Println("The entrypoint domain doesn't need a peer federator right now...")
-	} else {
-		isPeerFederatorHealthy, peerFederatorDomain, err := i.federatorSvc.CheckFederatorHealth(config.PEER_FEDERATOR_URL)
-		if err != nil {
-			log.Println("Impossible to check the peer federator health")
-			return err
-		} else if !isPeerFederatorHealthy {
-			return errors.New("the peer federator is unhealthy")
-		}
-		// Set the domain of the peer federator
-		config.PeerFederatorDomain = peerFederatorDomain
-		log.Println("The peer federator belongs to the Domain " + config.PeerFederatorDomain)
+		return nil
+	}
+	peerFederatorUrl := i.state.Peer().FederatorUrl
+	isPeerFederatorHealthy, peerFederatorDomain, err := i.federatorSvc.CheckFederatorHealth(peerFederatorUrl)
+	if err != nil {
+		log.Println("Impossible to check the peer federator health")
+		return err
+	} else if !isPeerFederatorHealthy {
+		return errors.New("the peer federator is unhealthy")
 	}
+	// Set the domain of the peer federator
+	i.state.SetPeerDomain(peerFederatorUrl, peerFederatorDomain)
+	log.Println("The peer federator belongs to the Domain " + peerFederatorDomain)
+	return nil
+}
 
-	if noNewDomain {
+// Create Domain entity in Orion
+func (i *Initialization) createDomain() error {
+	if i.domainExists {
 		log.Println("The Domain is already present in the Orion-LD of the Domain. This is not a new domain")
-	} else {
-		log.Println("The Domain is not present yet in the Orion-LD of the Domain. NEW DOMAIN ADDITION TO THE CONTINUUM")
+		return nil
+	}
+	log.Println("The Domain is not present yet in the Orion-LD of the Domain. NEW DOMAIN ADDITION TO THE CONTINUUM")
 
-		// Create Domain entity in Orion
-		log.Println("Creating the Domain entity in Orion-LD")
-		err := i.orionldSvc.CreateDomainEntity()
-		if err != nil {
-			return err
-		} else {
-			log.Println("Domain entity created")
-		}
+	// The entrypoint domain doesn't need to be spread, so it is functional from the beginning
+	status := config.INITIAL_DOMAIN_STATUS
+	if i.cfg().IsEntrypoint {
+		status = config.FUNCTIONAL_DOMAIN_STATUS
+	}
+	log.Println("Creating the Domain entity in Orion-LD")
+	err := i.orionldSvc.CreateDomainEntity(status)
+	if err != nil && !strings.HasPrefix(err.Error(), strconv.Itoa(http.StatusConflict)) {
+		return err
+	}
+	log.Println("Domain entity created")
+	i.domainExists = true
+	i.state.SetDomainStatus(status)
+	return nil
+}
 
-		// Check if isEntrypoint to not start the spreading process
-		if !config.IS_ENTRYPOINT {
-			log.Println("Spreading the creation of the new domain across the continuum...")
+// Spread this new domain creation to the Federator of the entrypoint domain (or other peer) -> SPREADING PROCESS
+func (i *Initialization) spread() error {
+	// Only the domains whose creation hasn't been spread yet are still Preliminary
+	if i.state.DomainStatus() != config.INITIAL_DOMAIN_STATUS {
+		return nil
+	}
+	if i.cfg().IsEntrypoint {
+		log.Println("This Federator belongs to the Entrypoint Domain")
+		return i.setFunctional()
+	}
 
-			// Spread this new domain creation to the Federator of the entrypoint domain (or other peer) -> SPREADING PROCESS
-			spreadResponse, err := i.federatorSvc.SpreadNewLocalDomain()
+	if !i.spreadDone {
+		log.Println("Spreading the creation of the new domain across the continuum...")
+		var registrations []models.ContextSourceRegistration
+		spreadResponse, err := i.federatorSvc.SpreadNewLocalDomain()
+		if err != nil && isAlreadyInTheContinuum(err) {
+			// Spread before a restart, but the domain wasn't set to Functional yet
+			log.Println("The creation of the new domain was already spread, so retrieving the domains of the continuum from the peer federator...")
+			registrations, err = i.continuumRegistrations()
 			if err != nil {
-				log.Println("Cannot contant with the peer domain to spread the new domain creation")
-				// TODO implement a logic here to handle this error...
-				// take some actions on the created domain entity -> delete it or mark with a new status (federationfailed?)
-				deleteEntityError := i.orionldSvc.DeleteLocalDomainEntity()
-				if deleteEntityError != nil {
-					log.Println(deleteEntityError)
-				}
 				return err
-			} else {
-				log.Println("The creation of the new domain has been successfully spread")
-				// fmt.Printf("%+v\n", *spreadResponse)
-
-				// CSRs from the peer federator are returned as response, so create them the local broker
-				log.Println("Creating CSRs pointing to the other brokers of the continuum")
-				i.orionldSvc.CreateContextSourceRegistrations(&spreadResponse.NewDomainRegistrations)
-
-				log.Println("Total number of domains (excluding the peer federator domain): " + strconv.Itoa(len(spreadResponse.Domains)))
-				for i := 0; i < len(spreadResponse.Domains); i++ {
-					log.Println(spreadResponse.Domains[i].Id + " " + spreadResponse.Domains[i].Description)
-				}
-				log.Println("Total number of FAILED domains: " + strconv.Itoa(len(spreadResponse.FailedDomains)))
-				if len(spreadResponse.FailedDomains) > 0 {
-					for _, d := range spreadResponse.FailedDomains {
-						log.Println(d)
-					}
-				}
 			}
+		} else if err != nil {
+			log.Println("Cannot contant with the peer domain to spread the new domain creation")
+			return err
 		} else {
-			log.Println("This Federator belongs to the Entrypoint Domain")
+			log.Println("The creation of the new domain has been successfully spread")
+			// CSRs from the peer federator are returned as response
+			registrations = i.acceptedRegistrations(spreadResponse)
+
+			log.Println("Total number of domains (excluding the peer federator domain): " + strconv.Itoa(len(spreadResponse.Domains)))
+			for _, domain := range spreadResponse.Domains {
+				log.Println(domain.Id + " " + domain.Description)
+			}
+			log.Println("Total number of FAILED domains: " + strconv.Itoa(len(spreadResponse.FailedDomains)))
+			for _, d := range spreadResponse.FailedDomains {
+				log.Println(d)
+			}
+		}
+
+		log.Println("Creating CSRs pointing to the other brokers of the continuum")
+		err = i.orionldSvc.CreateContextSourceRegistrations(&registrations)
+		if err != nil {
+			log.Println(err)
 		}
+		i.spreadDone = true
 	}
+	return i.setFunctional()
+}
+
+// Returns true if the peer federator rejected the spread because the domain is already in the continuum
+func isAlreadyInTheContinuum(err error) bool {
+	return strings.HasPrefix(err.Error(), strconv.Itoa(http.StatusBadRequest)) && strings.Contains(err.Error(), "already exists in the continuum")
+}
+
+// Builds the CSRs of the domains of the continuum as seen by the peer federator, restricted to the ones the
+// local sharing policy accepts, as the spread response would have returned
+func (i *Initialization) continuumRegistrations() (registrations []models.ContextSourceRegistration, err error) {
+	domains, err := i.federatorSvc.GetFederatorDomains(i.state.Peer().FederatorUrl)
+	if err != nil {
+		return nil, err
+	}
+	for j := range domains {
+		newDomain := models.NewDomainFromEntity(&domains[j])
+		if newDomain.Name == i.cfg().Domain.Name || domains[j].DomainStatus == config.DELETED_DOMAIN_STATUS {
+			continue
+		}
+		registrations = append(registrations, i.orionldSvc.GenerateAcceptedContextSourceRegistrations(newDomain)...)
+	}
+	return registrations, nil
+}
 
-	// Create the Organization entity of the Domain owner in the continuum
+// Restricts the CSRs returned by the peer federator to the ones the local sharing policy accepts. The peer
+// domain is not listed in the response, so only its name is known here; the reconciliation evaluates it again
+// with its organization and labels.
+func (i *Initialization) acceptedRegistrations(spreadResponse *models.NewDomainSpreadResponse) (registrations []models.ContextSourceRegistration) {
+	domains := make(map[string]*models.NewDomain)
+	for j := range spreadResponse.Domains {
+		domain := models.NewDomainFromEntity(&spreadResponse.Domains[j])
+		domains[domain.Name] = domain
+	}
+	for _, registration := range spreadResponse.NewDomainRegistrations {
+		domain, isKnown := domains[registration.AeriosDomain]
+		if !isKnown {
+			domain = &models.NewDomain{Name: registration.AeriosDomain}
+		}
+		registrations = append(registrations, i.cfg().SharingPolicy.FilterRegistration(registration, domain)...)
+	}
+	return registrations
+}
+
+func (i *Initialization) setFunctional() error {
+	err := i.orionldSvc.UpdateLocalDomainStatus(config.FUNCTIONAL_DOMAIN_STATUS)
+	if err != nil {
+		return err
+	}
+	i.state.SetDomainStatus(config.FUNCTIONAL_DOMAIN_STATUS)
+	log.Println("The local domain is now Functional")
+	return nil
+}
+
+// Create the Organization entity of the Domain owner in the continuum
+func (i *Initialization) createOrganization() error {
 	log.Println("Checking the existence of the Organization entity of the Domain owner in the continuum...")
-	noNewOrganization, orgErr := i.orionldSvc.ExistsOrganizationInTheContinuum(config.DOMAIN_OWNER)
+	noNewOrganization, orgErr := i.orionldSvc.ExistsOrganizationInTheContinuum(i.cfg().Domain.Owner)
 	if orgErr != nil {
 		log.Println("The existence of the organization entity cannot be checked, so creating it locally...")
 	}
-	if !noNewOrganization {
-		log.Println("The Organization entity is not present in the continuum, so creating it...")
-		orgErr = i.orionldSvc.CreateOrganizationEntity()
-		if orgErr != nil {
-			log.Println("Error creating the Organization entity in the continuum: " + orgErr.Error())
-		} else {
-			log.Println("Organization entity created successfully")
-		}
+	if noNewOrganization {
+		return nil
 	}
-
-	return err
+	log.Println("The Organization entity is not present in the continuum, so creating it...")
+	orgErr = i.orionldSvc.CreateOrganizationEntity()
+	if orgErr != nil && !strings.HasPrefix(orgErr.Error(), strconv.Itoa(http.StatusConflict)) {
+		log.Println("Error creating the Organization entity in the continuum: " + orgErr.Error())
+		return orgErr
+	}
+	log.Println("Organization entity created successfully")
+	return nil
 }
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+)
+
+// Remote domains seen through the local broker. The Domain entity of a domain is no longer retrieved once its
+// CSRs are suspended or expire, so its last known entity is kept (and persisted in KNOWN_DOMAINS_FILE, if
+// set) to keep monitoring it and register it again once it recovers, even after a restart.
+type KnownDomainRegistry struct {
+	store   *config.Store
+	mutex   sync.Mutex
+	domains map[string]models.DomainSimplified
+}
+
+func NewKnownDomainRegistry(store *config.Store) *KnownDomainRegistry {
+	registry := &KnownDomainRegistry{
+		store:   store,
+		domains: make(map[string]models.DomainSimplified),
+	}
+	registry.load()
+	return registry
+}
+
+func (r *KnownDomainRegistry) cfg() *config.Config {
+	return r.store.Get()
+}
+
+// Remembers the domains retrieved through the local broker (forgetting the removed ones) and returns the known
+// domains missing from them
+func (r *KnownDomainRegistry) Complete(domains []models.DomainSimplified) (missing []models.DomainSimplified) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	listed := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		name := models.GetNgsiLdEntityIdValue("Domain", domain.Id)
+		listed[name] = true
+		if domain.DomainStatus == config.DELETED_DOMAIN_STATUS {
+			delete(r.domains, name)
+		} else {
+			r.domains[name] = domain
+		}
+	}
+	for name, domain := range r.domains {
+		if !listed[name] {
+			missing = append(missing, domain)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Id < missing[j].Id })
+	r.save()
+	return missing
+}
+
+// Forgets a remote domain that has left the continuum
+func (r *KnownDomainRegistry) Forget(domainName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, isKnown := r.domains[domainName]; isKnown {
+		delete(r.domains, domainName)
+		r.save()
+	}
+}
+
+// Forgets all the remote domains, e.g. the local domain has left the continuum
+func (r *KnownDomainRegistry) Clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.domains = make(map[string]models.DomainSimplified)
+	r.save()
+}
+
+func (r *KnownDomainRegistry) load() {
+	file := r.cfg().KnownDomainsFile
+	if file == "" {
+		return
+	}
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Println("Cannot read the known domains file: " + err.Error())
+		return
+	}
+	if err := json.Unmarshal(content, &r.domains); err != nil {
+		log.Println("Invalid known domains file: " + err.Error())
+		r.domains = make(map[string]models.DomainSimplified)
+	}
+}
+
+// Writes the known domains to a temporary file renamed afterwards, so a crash never leaves a truncated file
+func (r *KnownDomainRegistry) save() {
+	file := r.cfg().KnownDomainsFile
+	if file == "" {
+		return
+	}
+	content, err := json.Marshal(r.domains)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.WriteFile(file+".tmp", content, 0o600); err != nil {
+		log.Println("Cannot write the known domains file: " + err.Error())
+		return
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Println("Cannot write the known domains file: " + err.Error())
+	}
+}
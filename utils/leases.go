@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+)
+
+// Periodically renews the lease (lastHeartbeat) of the local Domain entity and, depending on the
+// DOMAIN_LEASE_EXPIRY_CHECK mode, disables the remote domains whose lease has expired. The lastHeartbeat of a
+// remote domain is written by its own clock, so a lease expires after the local time at which its last change
+// was observed, not after the heartbeat itself, and clock skews between domains don't matter.
+type LeaseManager struct {
+	store           *config.Store
+	orionldSvc      services.OrionldSvc
+	federatorSvc    services.FederatorSvc
+	disabledDomains *DomainStatusRegistry
+	knownDomains    *KnownDomainRegistry
+	mutex           sync.Mutex
+	heartbeats      map[string]observedHeartbeat
+}
+
+// Last heartbeat of a remote domain and the local time at which it was observed for the first time
+type observedHeartbeat struct {
+	value      string
+	observedAt time.Time
+}
+
+func NewLeaseManager(store *config.Store, orionldSvc services.OrionldSvc, federatorSvc services.FederatorSvc, disabledDomains *DomainStatusRegistry, knownDomains *KnownDomainRegistry) *LeaseManager {
+	return &LeaseManager{
+		store:           store,
+		orionldSvc:      orionldSvc,
+		federatorSvc:    federatorSvc,
+		disabledDomains: disabledDomains,
+		knownDomains:    knownDomains,
+		heartbeats:      make(map[string]observedHeartbeat),
+	}
+}
+
+func (l *LeaseManager) cfg() *config.Config {
+	return l.store.Get()
+}
+
+func (l *LeaseManager) Start(tasks *BackgroundTasks) {
+	renewalInterval := func() time.Duration { return l.cfg().Lease.RenewalInterval }
+	tasks.Every(renewalInterval, false, l.renewLease)
+	if l.cfg().Lease.ExpiryCheck == "all" || (l.cfg().Lease.ExpiryCheck == "entrypoint" && l.cfg().IsEntrypoint) {
+		log.Println("Checking the expiration of the domain leases every " + l.cfg().Lease.RenewalInterval.String())
+		tasks.Every(renewalInterval, false, l.CheckExpiredLeases)
+	}
+}
+
+func (l *LeaseManager) renewLease() {
+	err := l.orionldSvc.RenewLocalDomainLease()
+	if err != nil {
+		log.Println("Cannot renew the lease of the local domain")
+		log.Println(err)
+	}
+}
+
+// Disables the remote domains with an expired lease and enables again the ones whose lease has been renewed
+func (l *LeaseManager) CheckExpiredLeases() {
+	idPattern := "^(?!" + models.BuildNgsiLdEntityId("Domain", l.cfg().Domain.Name) + "$).*$"
+	domains, _, err := l.orionldSvc.GetDomainEntities("simplified", false, "publicUrl,domainStatus,isEntrypoint,federatorUrl,brokerUrl,brokerId,tenant,lastHeartbeat,owner,labels,location,sharedEntityTypes", "", "", idPattern)
+	if err != nil {
+		log.Println("Cannot retrieve the domains to check their leases")
+		log.Println(err)
+		return
+	}
+
+	// The CSRs of the disabled domains are suspended (and the ones of other domains may have expired), so their
+	// Domain entities are retrieved from their Federators, keeping the last known ones if they are unreachable
+	for _, missingDomain := range l.knownDomains.Complete(domains) {
+		domain, err := l.federatorSvc.GetFederatorLocalDomain(missingDomain.GetFederatorUrl())
+		if err != nil {
+			domains = append(domains, missingDomain)
+			continue
+		}
+		domains = append(domains, *domain)
+	}
+
+	for i := range domains {
+		domain := &domains[i]
+		// Domains whose Federator doesn't support leases yet are never expired
+		if domain.LastHeartbeat == "" {
+			continue
+		}
+		observedAt := l.observeHeartbeat(domain)
+		if time.Since(observedAt) > l.cfg().Lease.Duration {
+			l.disabledDomains.Disable(domain, LEASE_EXPIRED_REASON, "last heartbeat "+domain.LastHeartbeat+" not renewed since "+observedAt.UTC().Format(time.RFC3339))
+		} else {
+			l.disabledDomains.Enable(domain, LEASE_EXPIRED_REASON)
+		}
+	}
+}
+
+// Returns the local time at which the current heartbeat of a remote domain was observed for the first time
+func (l *LeaseManager) observeHeartbeat(domain *models.DomainSimplified) time.Time {
+	domainName := models.GetNgsiLdEntityIdValue("Domain", domain.Id)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	observed, isObserved := l.heartbeats[domainName]
+	if !isObserved || observed.value != domain.LastHeartbeat {
+		observed = observedHeartbeat{value: domain.LastHeartbeat, observedAt: time.Now()}
+		l.heartbeats[domainName] = observed
+	}
+	return observed.observedAt
+}
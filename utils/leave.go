@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+)
+
+// Error of the leave flow, including the HTTP status code to be returned by the API
+type LeaveError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *LeaveError) Error() string {
+	return e.Message
+}
+
+// Removes the local domain from the continuum: marks it as Removed, spreads the deletion to the Federators
+// of the other domains and deletes the local CSRs. Used by DELETE /v1/domains/local and by the ephemeral
+// domain mode on shutdown.
+func (f *Federator) LeaveContinuum() (response *models.DeleteDomainSpreadResponse, err error) {
+	orionSvc := f.orionldSvc
+	federatorSvc := f.federatorSvc
+
+	// TODO solve in the future -> move the entrypoint domain?
+	if f.cfg().IsEntrypoint {
+		log.Println("The entrypoint domain cannot be deleted")
+		return nil, &LeaveError{http.StatusInternalServerError, "The entrypoint domain cannot be deleted"}
+	}
+
+	// Check if status is Removed
+	localDomain, err := orionSvc.GetLocalDomainEntity("simplified", "domainStatus", "")
+	if err != nil {
+		log.Println(err)
+		return nil, &LeaveError{http.StatusInternalServerError, "Cannot retrieve domain status"}
+	}
+	if localDomain.DomainStatus == config.DELETED_DOMAIN_STATUS {
+		return nil, &LeaveError{http.StatusBadRequest, "The domain has already been removed"}
+	}
+
+	// Update Domain status to Removed
+	err = orionSvc.UpdateLocalDomainStatus(config.DELETED_DOMAIN_STATUS)
+	if err != nil {
+		log.Println("Cannot update domain status to Removed")
+		log.Println(err)
+		return nil, &LeaveError{http.StatusInternalServerError, "Cannot update domain status to Removed"}
+	}
+	f.State.SetDomainStatus(config.DELETED_DOMAIN_STATUS)
+
+	// Spread the domain deletion among the brokers of the continuum (it only must be done by the entrypoint or selected peer federator)
+	// FIXME only functional domains -> domainsQuery := "domainStatus==\"" + config.FUNCTIONAL_DOMAIN_STATUS + "\""
+	domainsQuery := ""
+	domains, _, err := orionSvc.GetDomainEntities("simplified", true, "publicUrl,domainStatus,federatorUrl", domainsQuery, "", "")
+	if err != nil {
+		log.Println("Error when retrieving Domains")
+		return nil, &LeaveError{http.StatusInternalServerError, "Cannot retrieve continuum domains"}
+	}
+
+	// Send delete Domain requests to notify the other brokers
+	failedDomains := make([]string, 0)
+	queuedDomains := make([]string, 0)
+	if len(domains) == 0 {
+		log.Println("No domains to spread the domain deletion")
+	}
+	for _, domain := range domains {
+		if domain.Id == models.BuildNgsiLdEntityId("Domain", f.cfg().Domain.Name) {
+			continue
+		}
+		log.Println("Sending the domain deletion to domain " + domain.Id)
+		log.Println("DELETE request to " + domain.FederatorUrl + " pointing to domain " + domain.Id)
+
+		// If Federator URL is not included in the Domain entity, use publicUrl + "/federator"
+		federatorUrl := domain.GetFederatorUrl()
+		// Don't wait for domains that are known to be down, the notification will be retried later
+		if federatorSvc.IsCircuitOpen(federatorUrl) {
+			log.Println("The circuit breaker of domain " + domain.Id + " is open, so the notification is queued in the retry outbox")
+			f.RetryOutbox.EnqueueDeletedDomain(f.cfg().Domain.Name, domain.Id, federatorUrl)
+			queuedDomains = append(queuedDomains, domain.Id)
+			continue
+		}
+		err = federatorSvc.NotifyDeletedDomain(f.cfg().Domain.Name, federatorUrl)
+		if err != nil {
+			log.Println(err)
+			log.Println("Cannot contant with the domain to spread the domain deletion")
+			failedDomains = append(failedDomains, domain.Id)
+		}
+	}
+
+	// Delete CSR in the local broker
+	err = orionSvc.DeleteAeriosContextSourceRegistrations()
+	if err != nil {
+		log.Println("Cannot delete local CSRs")
+		return nil, &LeaveError{http.StatusInternalServerError, "Cannot delete local CSRs"}
+	}
+	f.KnownDomains.Clear()
+
+	response = &models.DeleteDomainSpreadResponse{
+		FailedDomains: failedDomains,
+		QueuedDomains: queuedDomains,
+	}
+	if len(queuedDomains) > 0 && len(failedDomains) == 0 {
+		response.Message = "Local domain " + f.cfg().Domain.Name + " successfully deleted, but the deletion has been queued for some unreachable domains"
+	} else if len(failedDomains) > 0 {
+		response.Message = "Local domain " + f.cfg().Domain.Name + " successfully deleted, but the deletion has failed in some domains"
+	} else {
+		response.Message = "Local domain " + f.cfg().Domain.Name + " successfully deleted"
+	}
+	return response, nil
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+)
+
+// In-memory outbox of the notifications to other Federators that could not be delivered during a
+// fan-out (e.g. open circuit breaker). They are retried with exponential backoff from the configured
+// retry interval and dropped after the maximum number of failed deliveries.
+type Outbox struct {
+	store        *config.Store
+	federatorSvc services.FederatorSvc
+	mutex        sync.Mutex
+	messages     []*models.OutboxMessage
+	sequence     int
+}
+
+func NewOutbox(store *config.Store, federatorSvc services.FederatorSvc) *Outbox {
+	return &Outbox{
+		store:        store,
+		federatorSvc: federatorSvc,
+	}
+}
+
+func (o *Outbox) cfg() *config.Config {
+	return o.store.Get()
+}
+
+func (o *Outbox) Start(tasks *BackgroundTasks) {
+	tasks.Every(func() time.Duration { return o.cfg().Outbox.RetryInterval }, false, func() { o.Flush(false) })
+}
+
+// Queues the notification of a new domain to the Federator of another domain
+func (o *Outbox) EnqueueNewDomain(newDomain *models.NewDomain, destination string, federatorUrl string) {
+	o.enqueue(&models.OutboxMessage{
+		Operation:    models.NEW_DOMAIN_NOTIFICATION,
+		Destination:  destination,
+		FederatorUrl: federatorUrl,
+		NewDomain:    newDomain,
+	})
+}
+
+// Queues the notification of a deleted domain to the Federator of another domain
+func (o *Outbox) EnqueueDeletedDomain(deletedDomain string, destination string, federatorUrl string) {
+	o.enqueue(&models.OutboxMessage{
+		Operation:     models.DELETED_DOMAIN_NOTIFICATION,
+		Destination:   destination,
+		FederatorUrl:  federatorUrl,
+		DeletedDomain: deletedDomain,
+	})
+}
+
+func (o *Outbox) enqueue(message *models.OutboxMessage) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.sequence++
+	message.Id = strconv.Itoa(o.sequence)
+	message.CreatedAt = time.Now()
+	message.NextAttemptAt = message.CreatedAt.Add(o.cfg().Outbox.RetryInterval)
+	o.messages = append(o.messages, message)
+	log.Println("Notification " + message.Operation + " to " + message.Destination + " queued in the retry outbox")
+}
+
+// Tries to deliver the pending notifications. If force is false, only the ones whose backoff has
+// expired and whose destination circuit breaker is not open are sent.
+// Returns the number of notifications still pending.
+func (o *Outbox) Flush(force bool) int {
+	o.mutex.Lock()
+	due := make([]*models.OutboxMessage, 0, len(o.messages))
+	for _, message := range o.messages {
+		if force || (time.Now().After(message.NextAttemptAt) && !o.federatorSvc.IsCircuitOpen(message.FederatorUrl)) {
+			due = append(due, message)
+		}
+	}
+	o.mutex.Unlock()
+
+	delivered := make(map[string]bool)
+	for _, message := range due {
+		err := o.deliver(message)
+		o.mutex.Lock()
+		message.Attempts++
+		if err == nil {
+			log.Println("Notification " + message.Operation + " to " + message.Destination + " delivered from the retry outbox")
+			delivered[message.Id] = true
+		} else {
+			message.LastError = err.Error()
+			message.NextAttemptAt = time.Now().Add(o.cfg().Outbox.RetryInterval * time.Duration(1<<min(message.Attempts, 6)))
+			if message.Attempts >= o.cfg().Outbox.MaxAttempts {
+				log.Println("Notification " + message.Operation + " to " + message.Destination + " dropped after " + strconv.Itoa(message.Attempts) + " attempts: " + message.LastError)
+				delivered[message.Id] = true
+			}
+		}
+		o.mutex.Unlock()
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	pending := make([]*models.OutboxMessage, 0, len(o.messages))
+	for _, message := range o.messages {
+		if !delivered[message.Id] {
+			pending = append(pending, message)
+		}
+	}
+	o.messages = pending
+	return len(o.messages)
+}
+
+func (o *Outbox) deliver(message *models.OutboxMessage) (err error) {
+	switch message.Operation {
+	case models.NEW_DOMAIN_NOTIFICATION:
+		_, err = o.federatorSvc.NotifyNewDomain(message.NewDomain, message.FederatorUrl)
+		// The destination has already registered the domain
+		if err != nil && strings.HasPrefix(err.Error(), strconv.Itoa(http.StatusConflict)) {
+			err = nil
+		}
+	case models.DELETED_DOMAIN_NOTIFICATION:
+		err = o.federatorSvc.NotifyDeletedDomain(message.DeletedDomain, message.FederatorUrl)
+	}
+	return
+}
+
+// Returns a snapshot of the pending notifications
+func (o *Outbox) Pending() []models.OutboxMessage {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	pending := make([]models.OutboxMessage, 0, len(o.messages))
+	for _, message := range o.messages {
+		pending = append(pending, *message)
+	}
+	return pending
+}
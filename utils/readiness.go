@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/state"
+)
+
+// Periodically checks the local dependencies of the Federator (local broker and local Domain entity) and
+// caches the result, so the readiness probe never calls remote peers nor the broker on each request
+type ReadinessChecker struct {
+	store          *config.Store
+	state          *state.RuntimeState
+	orionldSvc     services.OrionldSvc
+	initialization *Initialization
+	mutex          sync.RWMutex
+	status         models.ReadinessStatus
+}
+
+func NewReadinessChecker(store *config.Store, runtimeState *state.RuntimeState, orionldSvc services.OrionldSvc, initialization *Initialization) *ReadinessChecker {
+	return &ReadinessChecker{
+		store:          store,
+		state:          runtimeState,
+		orionldSvc:     orionldSvc,
+		initialization: initialization,
+		status: models.ReadinessStatus{
+			Status:  config.UNHEALTHY_STATUS,
+			Message: "The readiness of the aeriOS Federator has not been checked yet",
+		},
+	}
+}
+
+func (r *ReadinessChecker) cfg() *config.Config {
+	return r.store.Get()
+}
+
+func (r *ReadinessChecker) Start(tasks *BackgroundTasks) {
+	tasks.Every(func() time.Duration { return r.cfg().ReadinessCheckInterval }, true, r.Check)
+}
+
+// Ready means that the initialization has finished, the local broker is reachable and the local domain is Functional
+func (r *ReadinessChecker) Check() {
+	now := time.Now()
+	status := models.ReadinessStatus{
+		Status:        config.UNHEALTHY_STATUS,
+		OrionLdStatus: config.HEALTHY_STATUS,
+		LastChecked:   &now,
+	}
+
+	isOrionHealthy, err := r.orionldSvc.IsOrionHealthy()
+	if !r.initialization.IsCompleted() {
+		if !isOrionHealthy {
+			status.OrionLdStatus = config.UNHEALTHY_STATUS
+		}
+		status.Message = "The initialization of the aeriOS Federator is in progress"
+		if r.initialization.IsFailed() {
+			status.Message = "The initialization of the aeriOS Federator has failed, check the failed step"
+		}
+	} else if !isOrionHealthy {
+		status.OrionLdStatus = config.UNHEALTHY_STATUS
+		status.Message = "Orion-LD of the domain is unhealthy"
+		if err != nil {
+			status.Message += ": " + err.Error()
+		}
+	} else {
+		domain, err := r.orionldSvc.GetLocalDomainEntity("simplified", "domainStatus", "")
+		if err != nil {
+			status.Message = "Cannot retrieve local domain: " + err.Error()
+		} else {
+			r.state.SetDomainStatus(domain.DomainStatus)
+			status.DomainStatus = models.GetNgsiLdEntityIdValue("DomainStatus", domain.DomainStatus)
+			if domain.DomainStatus == config.FUNCTIONAL_DOMAIN_STATUS {
+				status.Status = config.HEALTHY_STATUS
+			} else {
+				status.Message = "The local domain is not Functional"
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	previousStatus := r.status.Status
+	r.status = status
+	r.mutex.Unlock()
+	if previousStatus != status.Status {
+		log.Println("Readiness of the aeriOS Federator changed to " + status.Status + " " + status.Message)
+	}
+}
+
+// Returns the last cached readiness, along with the current progress of the initialization
+func (r *ReadinessChecker) Status() models.ReadinessStatus {
+	r.mutex.RLock()
+	status := r.status
+	r.mutex.RUnlock()
+	progress := r.initialization.Progress()
+	status.Initialization = &progress
+	return status
+}
+
+func (r *ReadinessChecker) IsReady() bool {
+	return r.Status().Status == config.HEALTHY_STATUS
+}
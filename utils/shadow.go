@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+	"github.com/eclipse-aerios/federator/state"
+)
+
+// Shadow (canary) join mode: the CSRs pointing to a newly joined domain are created in auxiliary mode, so a
+// misconfigured broker cannot break the distributed queries, while the health monitor checks that federated
+// queries against the domain succeed. The domain is promoted to the regular CSRs after SHADOW_JOIN_PROMOTION_CHECKS
+// consecutive successful checks (if SHADOW_JOIN_AUTO_PROMOTE is enabled) or through the admin API.
+type ShadowManager struct {
+	store      *config.Store
+	state      *state.RuntimeState
+	orionldSvc services.OrionldSvc
+}
+
+func NewShadowManager(store *config.Store, runtimeState *state.RuntimeState, orionldSvc services.OrionldSvc) *ShadowManager {
+	return &ShadowManager{
+		store:      store,
+		state:      runtimeState,
+		orionldSvc: orionldSvc,
+	}
+}
+
+func (m *ShadowManager) cfg() *config.Config {
+	return m.store.Get()
+}
+
+// Puts a newly joined domain in shadow mode if it is enabled, returning whether it was not already in it
+func (m *ShadowManager) Join(domainName string) bool {
+	if !m.cfg().ShadowJoin.Enabled {
+		return false
+	}
+	if _, isShadow := m.state.ShadowDomain(domainName); isShadow {
+		return false
+	}
+	log.Println("Domain " + domainName + " joins in shadow mode, so its CSRs are auxiliary until it is promoted")
+	m.state.SetShadowDomain(models.ShadowDomain{Domain: domainName, Since: time.Now()})
+	return true
+}
+
+// Takes a domain out of the shadow mode without promoting it (e.g. its join has failed or it has been deleted)
+func (m *ShadowManager) Forget(domainName string) {
+	m.state.RemoveShadowDomain(domainName)
+}
+
+// Rebuilds the shadow mode of the domains after a restart from their CSRs, flagged while in shadow mode
+func (m *ShadowManager) Start() {
+	if !m.cfg().ShadowJoin.Enabled {
+		return
+	}
+	registrations, err := m.orionldSvc.GetAeriosContextSourceRegistrations("", false)
+	if err != nil {
+		log.Println("Cannot retrieve the local CSRs to restore the shadow domains")
+		log.Println(err)
+		return
+	}
+	for _, registration := range registrations {
+		if registration.AeriosShadow {
+			m.Join(registration.AeriosDomain)
+		}
+	}
+}
+
+// Checks the federated queries against every shadow domain, promoting the ones that pass enough checks
+func (m *ShadowManager) CheckDomains() {
+	for _, shadowDomain := range m.state.ShadowDomains() {
+		m.checkDomain(shadowDomain)
+	}
+}
+
+// Queries the Domain entity of the shadow domain through the local broker, so the query is forwarded to the
+// broker of the domain through its auxiliary CSR
+func (m *ShadowManager) checkDomain(shadowDomain models.ShadowDomain) {
+	_, err := m.federatedDomainEntity(shadowDomain.Domain)
+	now := time.Now()
+	shadowDomain.LastChecked = &now
+	if err != nil {
+		shadowDomain.SuccessfulChecks = 0
+		shadowDomain.Message = err.Error()
+	} else {
+		shadowDomain.SuccessfulChecks++
+		shadowDomain.Message = ""
+	}
+	// The domain may have been promoted or deleted during the check
+	if _, isShadow := m.state.ShadowDomain(shadowDomain.Domain); !isShadow {
+		return
+	}
+	m.state.SetShadowDomain(shadowDomain)
+
+	if m.cfg().ShadowJoin.AutoPromote && shadowDomain.SuccessfulChecks >= m.cfg().ShadowJoin.PromotionChecks {
+		log.Println("The federated queries against domain " + shadowDomain.Domain + " have succeeded " + strconv.Itoa(shadowDomain.SuccessfulChecks) + " times in a row")
+		if err := m.Promote(shadowDomain.Domain); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (m *ShadowManager) federatedDomainEntity(domainName string) (*models.DomainSimplified, error) {
+	idPattern := "^" + regexp.QuoteMeta(models.BuildNgsiLdEntityId("Domain", domainName)) + "$"
+	domains, _, err := m.orionldSvc.GetDomainEntities("simplified", false, "publicUrl,domainStatus,isEntrypoint,federatorUrl,brokerUrl,brokerId,tenant,owner,labels,location,sharedEntityTypes", "", "", idPattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(domains) != 1 {
+		return nil, errors.New(strconv.Itoa(http.StatusBadGateway) + ": the federated query has not returned the Domain entity of " + domainName)
+	}
+	return &domains[0], nil
+}
+
+// Replaces the auxiliary CSRs of a shadow domain with the regular ones
+func (m *ShadowManager) Promote(domainName string) error {
+	if _, isShadow := m.state.ShadowDomain(domainName); !isShadow {
+		return errors.New(strconv.Itoa(http.StatusNotFound) + ": the domain " + domainName + " is not in shadow mode")
+	}
+	domain, err := m.federatedDomainEntity(domainName)
+	if err != nil {
+		return err
+	}
+	if !m.state.RemoveShadowDomain(domainName) {
+		return nil
+	}
+	log.Println("Promoting domain " + domainName + " out of the shadow mode...")
+	current, err := m.orionldSvc.GetAeriosContextSourceRegistrations("aeriosDomain==\""+domainName+"\"", false)
+	if err != nil {
+		// The auxiliary CSRs are replaced by the next reconciliation
+		log.Println(err)
+		return nil
+	}
+	// The regular CSRs are created before the auxiliary ones are deleted, which are kept if the creation fails
+	reconcileRegistrations(m.orionldSvc, domainName, current, m.orionldSvc.GenerateAcceptedContextSourceRegistrations(models.NewDomainFromEntity(domain)))
+	log.Println("Domain " + domainName + " promoted")
+	return nil
+}
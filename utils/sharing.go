@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse-aerios/federator/config"
+	"github.com/eclipse-aerios/federator/models"
+	"github.com/eclipse-aerios/federator/services"
+)
+
+// Keeps the local CSRs pointing to the other domains aligned with the local sharing policy and the CSR
+// templates: the missing CSRs are created, the outdated ones replaced and the ones no longer accepted deleted.
+// It runs every SHARING_RECONCILE_INTERVAL and after each reload changing the policy or the templates.
+type SharingReconciler struct {
+	store           *config.Store
+	orionldSvc      services.OrionldSvc
+	disabledDomains *DomainStatusRegistry
+	monitor         *HealthMonitor
+	knownDomains    *KnownDomainRegistry
+	mutex           sync.Mutex
+}
+
+func NewSharingReconciler(store *config.Store, orionldSvc services.OrionldSvc, disabledDomains *DomainStatusRegistry, monitor *HealthMonitor, knownDomains *KnownDomainRegistry) *SharingReconciler {
+	return &SharingReconciler{
+		store:           store,
+		orionldSvc:      orionldSvc,
+		disabledDomains: disabledDomains,
+		monitor:         monitor,
+		knownDomains:    knownDomains,
+	}
+}
+
+func (r *SharingReconciler) cfg() *config.Config {
+	return r.store.Get()
+}
+
+func (r *SharingReconciler) Start(tasks *BackgroundTasks) {
+	log.Println("Reconciling the CSRs with the sharing policy every " + r.cfg().SharingReconcileInterval.String())
+	r.store.OnReload(func(previous *config.Config, current *config.Config) {
+		if !reflect.DeepEqual(previous.SharingPolicy, current.SharingPolicy) || !reflect.DeepEqual(previous.CsrTemplates, current.CsrTemplates) {
+			tasks.Go(r.Reconcile)
+		}
+	})
+	tasks.Every(func() time.Duration { return r.cfg().SharingReconcileInterval }, true, r.Reconcile)
+}
+
+// Returns the remote domains, as seen by the local broker, along with the known ones whose CSRs have expired
+// or been suspended, so they are registered again once they recover
+func (r *SharingReconciler) domains() ([]models.NewDomain, []models.DomainSimplified, error) {
+	idPattern := "^(?!" + models.BuildNgsiLdEntityId("Domain", r.cfg().Domain.Name) + "$).*$"
+	entities, _, err := r.orionldSvc.GetDomainEntities("simplified", false, "publicUrl,domainStatus,isEntrypoint,federatorUrl,brokerUrl,brokerId,tenant,owner,labels,location,sharedEntityTypes", "", "", idPattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	entities = append(entities, r.knownDomains.Complete(entities)...)
+	domains := make([]models.NewDomain, 0, len(entities))
+	for i := range entities {
+		domains = append(domains, *models.NewDomainFromEntity(&entities[i]))
+	}
+	return domains, entities, nil
+}
+
+// Returns the effective sharing with each remote domain
+func (r *SharingReconciler) Report() ([]models.DomainSharing, error) {
+	domains, _, err := r.domains()
+	if err != nil {
+		return nil, err
+	}
+	cfg := r.cfg()
+	report := make([]models.DomainSharing, 0, len(domains))
+	for i := range domains {
+		report = append(report, cfg.SharingPolicy.Report(&domains[i], cfg.CsrTemplates))
+	}
+	return report, nil
+}
+
+// Aligns the local CSRs of every remote domain with the CSRs accepted by the sharing policy. The disabled
+// and removed domains are skipped, since their CSRs are intentionally suspended or being deleted, and so are
+// the unhealthy ones if the CSR leases are enabled, since their CSRs are left to expire.
+func (r *SharingReconciler) Reconcile() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	domains, entities, err := r.domains()
+	if err != nil {
+		log.Println("Cannot retrieve the domains to reconcile their CSRs")
+		log.Println(err)
+		return
+	}
+	registrations, err := r.orionldSvc.GetAeriosContextSourceRegistrations("", false)
+	if err != nil {
+		log.Println("Cannot retrieve the local CSRs to reconcile them")
+		log.Println(err)
+		return
+	}
+
+	for i := range domains {
+		domain := &domains[i]
+		if r.disabledDomains.IsDisabled(domain.Name) || entities[i].DomainStatus == config.DELETED_DOMAIN_STATUS {
+			continue
+		}
+		if r.cfg().CsrLease.Enabled && !r.monitor.IsHealthy(domain.Name) {
+			continue
+		}
+		current := slices.DeleteFunc(slices.Clone(registrations), func(registration models.ContextSourceRegistration) bool {
+			return registration.AeriosDomain != domain.Name
+		})
+		reconcileRegistrations(r.orionldSvc, domain.Name, current, r.orionldSvc.GenerateAcceptedContextSourceRegistrations(domain))
+	}
+}
+
+// Aligns the CSRs of a domain with the desired ones. An outdated CSR is replaced by a new revision, which is
+// created before the outdated one is deleted, so the domain is never left without a registration.
+func reconcileRegistrations(orionldSvc services.OrionldSvc, domainName string, current []models.ContextSourceRegistration, desired []models.ContextSourceRegistration) {
+	for _, registration := range desired {
+		revisions := slices.DeleteFunc(slices.Clone(current), func(other models.ContextSourceRegistration) bool {
+			return models.RegistrationBaseId(other.Id) != registration.Id
+		})
+		upToDate := slices.IndexFunc(revisions, func(other models.ContextSourceRegistration) bool { return sameRegistration(other, registration) })
+		if upToDate < 0 {
+			if len(revisions) > 0 {
+				log.Println("Replacing the outdated CSR " + registration.Id + " of domain " + domainName)
+				registration.Id = models.NewRegistrationRevision(registration.Id)
+			} else {
+				log.Println("Creating the missing CSR " + registration.Id + " of domain " + domainName)
+			}
+			if err := orionldSvc.CreateContextSourceRegistrations(&[]models.ContextSourceRegistration{registration}); err != nil {
+				// The outdated CSR is kept until the next reconciliation
+				log.Println(err)
+				continue
+			}
+		}
+		for i, revision := range revisions {
+			if i == upToDate {
+				continue
+			}
+			if err := orionldSvc.DeleteContextSourceRegistration(revision.Id); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	for _, registration := range current {
+		isDesired := slices.ContainsFunc(desired, func(other models.ContextSourceRegistration) bool {
+			return other.Id == models.RegistrationBaseId(registration.Id)
+		})
+		if isDesired {
+			continue
+		}
+		log.Println("Deleting the CSR " + registration.Id + " of domain " + domainName + ", not accepted by the sharing policy")
+		if err := orionldSvc.DeleteContextSourceRegistration(registration.Id); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Compares the parts of two CSRs set by the templates, the shared entity types and the sharing policy,
+// ignoring the order of the lists, which the broker may not keep
+func sameRegistration(a models.ContextSourceRegistration, b models.ContextSourceRegistration) bool {
+	sorted := func(values []string) []string {
+		values = slices.Clone(values)
+		slices.Sort(values)
+		return values
+	}
+	// The inclusive mode is the default one, so the broker may omit it
+	mode := func(registration models.ContextSourceRegistration) string {
+		if registration.Mode == "" {
+			return models.INCLUSIVE_CSR_MODE
+		}
+		return registration.Mode
+	}
+	// Each registered entity type along with the attributes it is limited to
+	entities := func(registration models.ContextSourceRegistration) (entities []string) {
+		for _, info := range registration.Information {
+			attributes := strings.Join(sorted(info.PropertyNames), ",") + "|" + strings.Join(sorted(info.RelationshipNames), ",")
+			for _, entity := range info.Entities {
+				entities = append(entities, entity.Type+"|"+attributes)
+			}
+		}
+		return sorted(entities)
+	}
+	// The coordinates may be decoded with different numeric types, so the locations are compared as JSON
+	location := func(registration models.ContextSourceRegistration) string {
+		if registration.Location == nil {
+			return ""
+		}
+		locationJson, _ := json.Marshal(registration.Location)
+		return string(locationJson)
+	}
+	return mode(a) == mode(b) && a.AeriosShadow == b.AeriosShadow && a.Endpoint == b.Endpoint && a.Tenant == b.Tenant && location(a) == location(b) &&
+		slices.Equal(sorted(a.Operations), sorted(b.Operations)) &&
+		slices.Equal(entities(a), entities(b))
+}